@@ -0,0 +1,75 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// ClusterHelmRelease is the Schema for the clusterhelmreleases API. It
+// installs a chart which serves the whole cluster, such as an ingress
+// controller or cert-manager, into spec.targetNamespace, which is required.
+// ValuesFrom references are read from the target namespace.
+//
+// Creating a ClusterHelmRelease installs arbitrary charts with the operator's
+// privileges, so it should only be granted to platform admins.
+type ClusterHelmRelease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   HelmReleaseSpec   `json:"spec,omitempty"`
+	Status HelmReleaseStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterHelmReleaseList contains a list of ClusterHelmRelease
+type ClusterHelmReleaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterHelmRelease `json:"items"`
+}
+
+// GetReleaseName returns the name of the helm release managed by r.
+func (r *ClusterHelmRelease) GetReleaseName() string {
+	if r.Spec.ReleaseName != "" {
+		return r.Spec.ReleaseName
+	}
+	return r.Name
+}
+
+// GetTargetNamespace returns the namespace the chart of r is installed into.
+func (r *ClusterHelmRelease) GetTargetNamespace() string {
+	return r.Spec.TargetNamespace
+}
+
+// GetReleaseSpec returns the spec of r.
+func (r *ClusterHelmRelease) GetReleaseSpec() *HelmReleaseSpec {
+	return &r.Spec
+}
+
+// GetReleaseStatus returns the status of r.
+func (r *ClusterHelmRelease) GetReleaseStatus() *HelmReleaseStatus {
+	return &r.Status
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterHelmRelease{}, &ClusterHelmReleaseList{})
+}
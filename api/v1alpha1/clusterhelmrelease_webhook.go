@@ -0,0 +1,98 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var clusterhelmreleaselog = logf.Log.WithName("clusterhelmrelease-resource")
+
+// SetupWebhookWithManager registers the ClusterHelmRelease webhooks with mgr.
+func (r *ClusterHelmRelease) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-operators-alexeldeib-xyz-v1alpha1-clusterhelmrelease,mutating=true,failurePolicy=fail,groups=operators.alexeldeib.xyz,resources=clusterhelmreleases,verbs=create;update,versions=v1alpha1,name=mclusterhelmrelease.kb.io
+
+var _ webhook.Defaulter = &ClusterHelmRelease{}
+
+// Default implements webhook.Defaulter. There is no default target
+// namespace; a cluster-wide release must say where it is installed.
+func (r *ClusterHelmRelease) Default() {
+	clusterhelmreleaselog.Info("default", "name", r.Name)
+
+	if r.Spec.ReleaseName == "" && r.Name != "" {
+		r.Spec.ReleaseName = r.Name
+	}
+	r.Spec.setDefaults()
+}
+
+// +kubebuilder:webhook:path=/validate-operators-alexeldeib-xyz-v1alpha1-clusterhelmrelease,mutating=false,failurePolicy=fail,groups=operators.alexeldeib.xyz,resources=clusterhelmreleases,verbs=create;update,versions=v1alpha1,name=vclusterhelmrelease.kb.io
+
+var _ webhook.Validator = &ClusterHelmRelease{}
+
+// ValidateCreate implements webhook.Validator.
+func (r *ClusterHelmRelease) ValidateCreate() error {
+	clusterhelmreleaselog.Info("validate create", "name", r.Name)
+
+	return r.toInvalid(r.validateSpec())
+}
+
+// ValidateUpdate implements webhook.Validator. Like HelmRelease, objects
+// being deleted and updates which leave the spec alone are not validated.
+func (r *ClusterHelmRelease) ValidateUpdate(old runtime.Object) error {
+	clusterhelmreleaselog.Info("validate update", "name", r.Name)
+
+	previous, ok := old.(*ClusterHelmRelease)
+	if !r.DeletionTimestamp.IsZero() || ok && apiequality.Semantic.DeepEqual(r.Spec, previous.Spec) {
+		return nil
+	}
+	allErrs := r.validateSpec()
+	if ok {
+		allErrs = append(allErrs, validateReleaseIdentity(r, previous)...)
+	}
+	return r.toInvalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator.
+func (r *ClusterHelmRelease) ValidateDelete() error {
+	return nil
+}
+
+func (r *ClusterHelmRelease) validateSpec() field.ErrorList {
+	allErrs := r.Spec.validate(r.GetReleaseName())
+	if r.Spec.TargetNamespace == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec", "targetNamespace"), "a cluster-wide release must name its target namespace"))
+	}
+	return allErrs
+}
+
+func (r *ClusterHelmRelease) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("ClusterHelmRelease").GroupKind(), r.Name, allErrs)
+}
@@ -0,0 +1,91 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("ClusterHelmRelease webhook", func() {
+	var release *ClusterHelmRelease
+
+	BeforeEach(func() {
+		release = &ClusterHelmRelease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "cert-manager",
+			},
+			Spec: HelmReleaseSpec{
+				Chart:           "jetstack/cert-manager",
+				TargetNamespace: "cert-manager",
+			},
+		}
+	})
+
+	Context("Default", func() {
+		It("should write explicit defaults into the spec", func() {
+			release.Default()
+			Expect(release.Spec.ReleaseName).To(Equal("cert-manager"))
+			Expect(release.Spec.TargetNamespace).To(Equal("cert-manager"))
+			Expect(release.Spec.Timeout.Duration).To(Equal(DefaultTimeout))
+			Expect(release.Spec.DeletionPolicy).To(Equal(DeletionPolicyPurge))
+			Expect(release.ValidateCreate()).To(Succeed())
+		})
+
+		It("should not invent a target namespace", func() {
+			release.Spec.TargetNamespace = ""
+			release.Default()
+			Expect(release.Spec.TargetNamespace).To(BeEmpty())
+		})
+	})
+
+	Context("ValidateCreate", func() {
+		It("should accept a valid release", func() {
+			Expect(release.ValidateCreate()).To(Succeed())
+		})
+
+		It("should require a target namespace", func() {
+			release.Spec.TargetNamespace = ""
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should validate the shared spec fields", func() {
+			release.Spec.Chart = "cert-manager"
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+		})
+	})
+
+	Context("ValidateUpdate", func() {
+		It("should reject a target namespace change", func() {
+			updated := release.DeepCopy()
+			updated.Spec.TargetNamespace = "kube-system"
+			Expect(updated.ValidateUpdate(release)).NotTo(Succeed())
+		})
+
+		It("should reject a release name change", func() {
+			updated := release.DeepCopy()
+			updated.Spec.ReleaseName = "bar"
+			Expect(updated.ValidateUpdate(release)).NotTo(Succeed())
+		})
+
+		It("should not validate an unchanged spec", func() {
+			release.Spec.TargetNamespace = ""
+			Expect(release.DeepCopy().ValidateUpdate(release)).To(Succeed())
+		})
+	})
+})
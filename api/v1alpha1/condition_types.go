@@ -0,0 +1,83 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionType is the type of a status condition.
+type ConditionType string
+
+// Condition is an observation of one aspect of an object's state.
+type Condition struct {
+	Type   ConditionType          `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a one word, CamelCase reason for the last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// FindCondition returns the condition of type t, or nil.
+func FindCondition(conditions []Condition, t ConditionType) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == t {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionTrue reports whether the condition of type t is present and true.
+func IsConditionTrue(conditions []Condition, t ConditionType) bool {
+	c := FindCondition(conditions, t)
+	return c != nil && c.Status == corev1.ConditionTrue
+}
+
+// SetCondition adds or updates the condition of the same type in conditions.
+// LastTransitionTime only moves when the status changes.
+func SetCondition(conditions *[]Condition, condition Condition) {
+	existing := FindCondition(*conditions, condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		*conditions = append(*conditions, condition)
+		return
+	}
+	if existing.Status != condition.Status {
+		existing.Status = condition.Status
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+}
+
+// RemoveCondition drops the condition of type t from conditions.
+func RemoveCondition(conditions *[]Condition, t ConditionType) {
+	var kept []Condition
+	for _, c := range *conditions {
+		if c.Type != t {
+			kept = append(kept, c)
+		}
+	}
+	*conditions = kept
+}
@@ -0,0 +1,230 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"strings"
+
+	fuzz "github.com/google/gofuzz"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/diff"
+
+	"github.com/alexeldeib/operators/api/v1beta1"
+)
+
+const fuzzIterations = 1000
+
+// setValueReplacer strips the characters which would split or escape a
+// fuzzed SetValue once it is written as a --set argument.
+var setValueReplacer = strings.NewReplacer("=", "", ",", "", "\\", "")
+
+// conversionFuzzer fills objects of either version with random content that
+// the API server would accept.
+func conversionFuzzer() *fuzz.Fuzzer {
+	return fuzz.New().NilChance(0.3).Funcs(
+		// The conversion webhook sets apiVersion and kind itself.
+		func(t *metav1.TypeMeta, c fuzz.Continue) {},
+		func(m *metav1.ObjectMeta, c fuzz.Continue) {
+			m.Name = c.RandString()
+			m.Namespace = c.RandString()
+			c.Fuzz(&m.Labels)
+			c.Fuzz(&m.Annotations)
+		},
+		func(spec *HelmReleaseSpec, c fuzz.Continue) {
+			c.FuzzNoCustom(spec)
+			switch c.Intn(3) {
+			case 0:
+				// Free text, which is rarely a YAML map.
+			case 1:
+				spec.Values = ""
+			case 2:
+				spec.Values = "# comments survive conversion\ncontroller:\n  replicaCount: 2\n"
+			}
+		},
+		func(spec *v1beta1.HelmReleaseSpec, c fuzz.Continue) {
+			c.FuzzNoCustom(spec)
+			// Names with "=" and values with bare commas are rejected by
+			// validation.
+			for _, set := range [][]v1beta1.SetValue{spec.Set, spec.SensitiveSet} {
+				for i := range set {
+					set[i].Name = setValueReplacer.Replace(set[i].Name)
+					set[i].Value = setValueReplacer.Replace(set[i].Value)
+				}
+			}
+		},
+		// Values are always an object, as the API server only stores JSON.
+		func(ext *runtime.RawExtension, c fuzz.Continue) {
+			values := map[string]string{}
+			c.Fuzz(&values)
+			if values == nil {
+				values = map[string]string{}
+			}
+			raw, err := json.Marshal(values)
+			Expect(err).NotTo(HaveOccurred())
+			ext.Raw = raw
+		},
+		// The controller keeps the booleans in step with the conditions.
+		func(status *NginxIngressStatus, c fuzz.Continue) {
+			c.FuzzNoCustom(status)
+			status.PublicIPReady = IsConditionTrue(status.Conditions, ConditionPublicIPReady)
+			status.HelmReleaseReady = IsConditionTrue(status.Conditions, ConditionReleaseReady)
+		},
+	)
+}
+
+var _ = Describe("Conversion", func() {
+	var f *fuzz.Fuzzer
+
+	BeforeEach(func() {
+		f = conversionFuzzer()
+	})
+
+	Context("HelmRelease", func() {
+		It("should round-trip v1alpha1 through the hub", func() {
+			for i := 0; i < fuzzIterations; i++ {
+				original := &HelmRelease{}
+				f.Fuzz(original)
+
+				hub := &v1beta1.HelmRelease{}
+				Expect(original.DeepCopy().ConvertTo(hub)).To(Succeed())
+				converted := &HelmRelease{}
+				Expect(converted.ConvertFrom(hub)).To(Succeed())
+
+				Expect(apiequality.Semantic.DeepEqual(original, converted)).To(BeTrue(), diff.ObjectReflectDiff(original, converted))
+			}
+		})
+
+		It("should round-trip the hub through v1alpha1", func() {
+			for i := 0; i < fuzzIterations; i++ {
+				original := &v1beta1.HelmRelease{}
+				f.Fuzz(original)
+
+				spoke := &HelmRelease{}
+				Expect(spoke.ConvertFrom(original.DeepCopy())).To(Succeed())
+				converted := &v1beta1.HelmRelease{}
+				Expect(spoke.ConvertTo(converted)).To(Succeed())
+
+				Expect(apiequality.Semantic.DeepEqual(original, converted)).To(BeTrue(), diff.ObjectReflectDiff(original, converted))
+			}
+		})
+
+		It("should structure values and overrides", func() {
+			release := &HelmRelease{
+				Spec: HelmReleaseSpec{
+					Values:             "controller:\n  replicaCount: 2\n",
+					Overrides:          []string{"controller.image.tag=0.25.0", "rbac.create=true"},
+					SensitiveOverrides: []string{"password=a=b"},
+				},
+			}
+			hub := &v1beta1.HelmRelease{}
+			Expect(release.ConvertTo(hub)).To(Succeed())
+
+			Expect(string(hub.Spec.Values.Raw)).To(Equal(`{"controller":{"replicaCount":2}}`))
+			Expect(hub.Spec.Set).To(Equal([]v1beta1.SetValue{
+				{Name: "controller.image.tag", Value: "0.25.0"},
+				{Name: "rbac.create", Value: "true"},
+			}))
+			Expect(hub.Spec.SensitiveSet).To(Equal([]v1beta1.SetValue{{Name: "password", Value: "a=b"}}))
+			Expect(hub.Annotations).NotTo(HaveKey(valuesAnnotation))
+		})
+
+		It("should split overrides which set several values", func() {
+			release := &HelmRelease{
+				Spec: HelmReleaseSpec{
+					Overrides: []string{`a=1,b=2`, `list={x,y},escaped=c\,d`, `url=http://example.com/?q=1`},
+				},
+			}
+			hub := &v1beta1.HelmRelease{}
+			Expect(release.DeepCopy().ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Set).To(Equal([]v1beta1.SetValue{
+				{Name: "a", Value: "1"},
+				{Name: "b", Value: "2"},
+				{Name: "list", Value: "{x,y}"},
+				{Name: "escaped", Value: `c\,d`},
+				{Name: "url", Value: "http://example.com/?q=1"},
+			}))
+
+			// The original grouping is kept for v1alpha1 clients.
+			converted := &HelmRelease{}
+			Expect(converted.ConvertFrom(hub)).To(Succeed())
+			Expect(converted.Spec.Overrides).To(Equal(release.Spec.Overrides))
+		})
+
+		It("should prefer hub edits over the original v1alpha1 values", func() {
+			release := &HelmRelease{
+				Spec: HelmReleaseSpec{
+					Values: "# tuned for prod\ncontroller:\n  replicaCount: 2\n",
+				},
+			}
+			hub := &v1beta1.HelmRelease{}
+			Expect(release.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Annotations).To(HaveKey(valuesAnnotation))
+
+			hub.Spec.Values = &runtime.RawExtension{Raw: []byte(`{"controller":{"replicaCount":3}}`)}
+			converted := &HelmRelease{}
+			Expect(converted.ConvertFrom(hub)).To(Succeed())
+			Expect(converted.Spec.Values).To(Equal("controller:\n  replicaCount: 3\n"))
+			Expect(converted.Annotations).NotTo(HaveKey(valuesAnnotation))
+		})
+	})
+
+	Context("NginxIngress", func() {
+		It("should round-trip v1alpha1 through the hub", func() {
+			for i := 0; i < fuzzIterations; i++ {
+				original := &NginxIngress{}
+				f.Fuzz(original)
+
+				hub := &v1beta1.NginxIngress{}
+				Expect(original.DeepCopy().ConvertTo(hub)).To(Succeed())
+				converted := &NginxIngress{}
+				Expect(converted.ConvertFrom(hub)).To(Succeed())
+
+				Expect(apiequality.Semantic.DeepEqual(original, converted)).To(BeTrue(), diff.ObjectReflectDiff(original, converted))
+			}
+		})
+
+		It("should round-trip the hub through v1alpha1", func() {
+			for i := 0; i < fuzzIterations; i++ {
+				original := &v1beta1.NginxIngress{}
+				f.Fuzz(original)
+
+				spoke := &NginxIngress{}
+				Expect(spoke.ConvertFrom(original.DeepCopy())).To(Succeed())
+				converted := &v1beta1.NginxIngress{}
+				Expect(spoke.ConvertTo(converted)).To(Succeed())
+
+				Expect(apiequality.Semantic.DeepEqual(original, converted)).To(BeTrue(), diff.ObjectReflectDiff(original, converted))
+			}
+		})
+
+		It("should report readiness set by older controllers as conditions", func() {
+			ingress := &NginxIngress{
+				Status: NginxIngressStatus{PublicIPReady: true},
+			}
+			hub := &v1beta1.NginxIngress{}
+			Expect(ingress.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Status.Conditions).To(HaveLen(1))
+			Expect(hub.Status.Conditions[0].Type).To(Equal(v1beta1.ConditionPublicIPReady))
+			Expect(string(hub.Status.Conditions[0].Status)).To(Equal("True"))
+		})
+	})
+})
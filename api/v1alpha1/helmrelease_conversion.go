@@ -0,0 +1,328 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"strings"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+	"sigs.k8s.io/yaml"
+
+	"github.com/alexeldeib/operators/api/v1beta1"
+)
+
+// valuesAnnotation holds the v1alpha1 form of values and overrides when it
+// cannot be rebuilt from the v1beta1 form, e.g. because the values text
+// carries comments or an override has no "=" or sets several values.
+const valuesAnnotation = "operators.alexeldeib.xyz/v1alpha1-values"
+
+var _ conversion.Convertible = &HelmRelease{}
+
+// alphaValues are the v1alpha1 fields whose v1beta1 form is structured.
+type alphaValues struct {
+	Values             string   `json:"values,omitempty"`
+	Overrides          []string `json:"overrides,omitempty"`
+	SensitiveOverrides []string `json:"sensitiveOverrides,omitempty"`
+}
+
+// ConvertTo converts this HelmRelease to the hub version.
+func (src *HelmRelease) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.HelmRelease)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	removeAnnotation(&dst.ObjectMeta.Annotations, valuesAnnotation)
+
+	dst.Spec.Chart = src.Spec.Chart
+	dst.Spec.Version = src.Spec.Version
+	dst.Spec.ReleaseName = src.Spec.ReleaseName
+	dst.Spec.TargetNamespace = src.Spec.TargetNamespace
+	dst.Spec.Timeout = src.Spec.Timeout.DeepCopy()
+	dst.Spec.DeletionPolicy = v1beta1.DeletionPolicy(src.Spec.DeletionPolicy)
+	if src.Spec.Retry != nil {
+		dst.Spec.Retry = &v1beta1.RetryPolicy{}
+		convertRetryPolicyTo(src.Spec.Retry, dst.Spec.Retry)
+	} else {
+		dst.Spec.Retry = nil
+	}
+	dst.Spec.ValuesFrom = nil
+	for _, ref := range src.Spec.ValuesFrom {
+		dst.Spec.ValuesFrom = append(dst.Spec.ValuesFrom, v1beta1.ValuesReference{
+			SecretKeyRef:    ref.SecretKeyRef.DeepCopy(),
+			ConfigMapKeyRef: ref.ConfigMapKeyRef.DeepCopy(),
+		})
+	}
+
+	values := alphaValues{
+		Values:             src.Spec.Values,
+		Overrides:          src.Spec.Overrides,
+		SensitiveOverrides: src.Spec.SensitiveOverrides,
+	}
+	dst.Spec.Values, dst.Spec.Set, dst.Spec.SensitiveSet = values.toHub()
+	if !apiequality.Semantic.DeepEqual(values, alphaValuesFromHub(&dst.Spec)) {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		setAnnotation(&dst.ObjectMeta.Annotations, valuesAnnotation, string(data))
+	}
+
+	dst.Status.Phase = v1beta1.ReleasePhase(src.Status.ProvisioningState)
+	dst.Status.Revision = src.Status.Revision
+	dst.Status.AdoptedRevision = src.Status.AdoptedRevision
+	dst.Status.Message = src.Status.Message
+	dst.Status.ObservedGeneration = src.Status.ObservedGeneration
+	dst.Status.LastAppliedGeneration = src.Status.LastAppliedGeneration
+	dst.Status.LastAppliedValuesHash = src.Status.LastAppliedValuesHash
+	dst.Status.Failures = src.Status.Failures
+	dst.Status.LastFailureTime = src.Status.LastFailureTime.DeepCopy()
+	dst.Status.LastFailureReason = src.Status.LastFailureReason
+	dst.Status.NextRetryTime = src.Status.NextRetryTime.DeepCopy()
+	dst.Status.Conditions = convertConditionsTo(src.Status.Conditions)
+
+	return nil
+}
+
+// ConvertFrom converts from the hub version to this version.
+func (dst *HelmRelease) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.HelmRelease)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	stored, hasStored := dst.ObjectMeta.Annotations[valuesAnnotation]
+	removeAnnotation(&dst.ObjectMeta.Annotations, valuesAnnotation)
+
+	dst.Spec.Chart = src.Spec.Chart
+	dst.Spec.Version = src.Spec.Version
+	dst.Spec.ReleaseName = src.Spec.ReleaseName
+	dst.Spec.TargetNamespace = src.Spec.TargetNamespace
+	dst.Spec.Timeout = src.Spec.Timeout.DeepCopy()
+	dst.Spec.DeletionPolicy = DeletionPolicy(src.Spec.DeletionPolicy)
+	if src.Spec.Retry != nil {
+		dst.Spec.Retry = &RetryPolicy{}
+		convertRetryPolicyFrom(src.Spec.Retry, dst.Spec.Retry)
+	} else {
+		dst.Spec.Retry = nil
+	}
+	dst.Spec.ValuesFrom = nil
+	for _, ref := range src.Spec.ValuesFrom {
+		dst.Spec.ValuesFrom = append(dst.Spec.ValuesFrom, ValuesReference{
+			SecretKeyRef:    ref.SecretKeyRef.DeepCopy(),
+			ConfigMapKeyRef: ref.ConfigMapKeyRef.DeepCopy(),
+		})
+	}
+
+	values := alphaValuesFromHub(&src.Spec)
+	// Prefer the original v1alpha1 text, unless the hub has been changed
+	// since it was stored.
+	if hasStored {
+		var original alphaValues
+		if err := json.Unmarshal([]byte(stored), &original); err == nil {
+			hubValues, set, sensitiveSet := original.toHub()
+			if sameValues(hubValues, src.Spec.Values) &&
+				apiequality.Semantic.DeepEqual(set, src.Spec.Set) &&
+				apiequality.Semantic.DeepEqual(sensitiveSet, src.Spec.SensitiveSet) {
+				values = original
+			}
+		}
+	}
+	dst.Spec.Values = values.Values
+	dst.Spec.Overrides = values.Overrides
+	dst.Spec.SensitiveOverrides = values.SensitiveOverrides
+
+	dst.Status.ProvisioningState = string(src.Status.Phase)
+	dst.Status.Revision = src.Status.Revision
+	dst.Status.AdoptedRevision = src.Status.AdoptedRevision
+	dst.Status.Message = src.Status.Message
+	dst.Status.ObservedGeneration = src.Status.ObservedGeneration
+	dst.Status.LastAppliedGeneration = src.Status.LastAppliedGeneration
+	dst.Status.LastAppliedValuesHash = src.Status.LastAppliedValuesHash
+	dst.Status.Failures = src.Status.Failures
+	dst.Status.LastFailureTime = src.Status.LastFailureTime.DeepCopy()
+	dst.Status.LastFailureReason = src.Status.LastFailureReason
+	dst.Status.NextRetryTime = src.Status.NextRetryTime.DeepCopy()
+	dst.Status.Conditions = convertConditionsFrom(src.Status.Conditions)
+
+	return nil
+}
+
+// toHub returns the v1beta1 form of v. Values which are not a YAML map have
+// no v1beta1 form and are dropped; the caller keeps them in an annotation.
+func (v alphaValues) toHub() (*runtime.RawExtension, []v1beta1.SetValue, []v1beta1.SetValue) {
+	var values *runtime.RawExtension
+	if v.Values != "" {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal([]byte(v.Values), &doc); err == nil && doc != nil {
+			if raw, err := json.Marshal(doc); err == nil {
+				values = &runtime.RawExtension{Raw: raw}
+			}
+		}
+	}
+	return values, toSetValues(v.Overrides), toSetValues(v.SensitiveOverrides)
+}
+
+// alphaValuesFromHub returns the v1alpha1 form of the values in spec.
+func alphaValuesFromHub(spec *v1beta1.HelmReleaseSpec) alphaValues {
+	var v alphaValues
+	if spec.Values != nil && len(spec.Values.Raw) > 0 {
+		if text, err := yaml.JSONToYAML(spec.Values.Raw); err == nil {
+			v.Values = string(text)
+		}
+	}
+	v.Overrides = fromSetValues(spec.Set)
+	v.SensitiveOverrides = fromSetValues(spec.SensitiveSet)
+	return v
+}
+
+// sameValues reports whether a and b hold the same values, regardless of how
+// their JSON is formatted.
+func sameValues(a, b *runtime.RawExtension) bool {
+	var docA, docB interface{}
+	if a != nil && len(a.Raw) > 0 {
+		if err := json.Unmarshal(a.Raw, &docA); err != nil {
+			return false
+		}
+	}
+	if b != nil && len(b.Raw) > 0 {
+		if err := json.Unmarshal(b.Raw, &docB); err != nil {
+			return false
+		}
+	}
+	return apiequality.Semantic.DeepEqual(docA, docB)
+}
+
+// toSetValues splits overrides, each of which may set several values as
+// helm's --set does, into one SetValue per value. Values keep helm's syntax,
+// escapes included, since SetValue.Value is parsed the same way.
+func toSetValues(overrides []string) []v1beta1.SetValue {
+	if overrides == nil {
+		return nil
+	}
+	set := make([]v1beta1.SetValue, 0, len(overrides))
+	for _, override := range overrides {
+		for _, pair := range splitOverride(override) {
+			i := strings.Index(pair, "=")
+			if i < 0 {
+				set = append(set, v1beta1.SetValue{Name: pair})
+				continue
+			}
+			set = append(set, v1beta1.SetValue{Name: pair[:i], Value: pair[i+1:]})
+		}
+	}
+	return set
+}
+
+// splitOverride splits a --set argument on the commas which separate its
+// name=value pairs, i.e. those which are neither escaped with a backslash
+// nor inside a {a,b} list value.
+func splitOverride(override string) []string {
+	var pairs []string
+	start, value := 0, -1
+	escaped, inList := false, false
+	for i, r := range override {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '=' && value < 0:
+			value = i + 1
+		case r == '{' && i == value:
+			inList = true
+		case r == '}' && inList:
+			inList = false
+		case r == ',' && !inList:
+			pairs = append(pairs, override[start:i])
+			start, value = i+1, -1
+		}
+	}
+	return append(pairs, override[start:])
+}
+
+func fromSetValues(set []v1beta1.SetValue) []string {
+	if set == nil {
+		return nil
+	}
+	overrides := make([]string, 0, len(set))
+	for _, s := range set {
+		overrides = append(overrides, s.Name+"="+s.Value)
+	}
+	return overrides
+}
+
+func convertRetryPolicyTo(src *RetryPolicy, dst *v1beta1.RetryPolicy) {
+	if src.MaxAttempts != nil {
+		maxAttempts := *src.MaxAttempts
+		dst.MaxAttempts = &maxAttempts
+	}
+	dst.InitialBackoff = src.InitialBackoff.DeepCopy()
+	dst.MaxBackoff = src.MaxBackoff.DeepCopy()
+}
+
+func convertRetryPolicyFrom(src *v1beta1.RetryPolicy, dst *RetryPolicy) {
+	if src.MaxAttempts != nil {
+		maxAttempts := *src.MaxAttempts
+		dst.MaxAttempts = &maxAttempts
+	}
+	dst.InitialBackoff = src.InitialBackoff.DeepCopy()
+	dst.MaxBackoff = src.MaxBackoff.DeepCopy()
+}
+
+func convertConditionsTo(src []Condition) []v1beta1.Condition {
+	if src == nil {
+		return nil
+	}
+	dst := make([]v1beta1.Condition, 0, len(src))
+	for _, c := range src {
+		dst = append(dst, v1beta1.Condition{
+			Type:               v1beta1.ConditionType(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+	return dst
+}
+
+func convertConditionsFrom(src []v1beta1.Condition) []Condition {
+	if src == nil {
+		return nil
+	}
+	dst := make([]Condition, 0, len(src))
+	for _, c := range src {
+		dst = append(dst, Condition{
+			Type:               ConditionType(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+	return dst
+}
+
+func setAnnotation(annotations *map[string]string, key, value string) {
+	if *annotations == nil {
+		*annotations = map[string]string{}
+	}
+	(*annotations)[key] = value
+}
+
+func removeAnnotation(annotations *map[string]string, key string) {
+	delete(*annotations, key)
+}
@@ -16,6 +16,9 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -27,20 +30,162 @@ type HelmReleaseSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	Chart string `json:"chart"`
+	// Version pins the chart version, like helm's --version flag. Defaults to
+	// the latest version.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// ReleaseName is the name of the helm release. Helm release names are
+	// global to the cluster. Defaults to the name of the HelmRelease and
+	// cannot be changed.
+	// +optional
+	ReleaseName string `json:"releaseName,omitempty"`
+	// TargetNamespace is the namespace the chart is installed into. It
+	// cannot be changed. A HelmRelease may only install into its own
+	// namespace, which is the default.
+	// +optional
+	TargetNamespace string `json:"targetNamespace,omitempty"`
 	// +optional
 	Values string `json:"values,omitempty"`
 	// +optional
 	Overrides []string `json:"overrides,omitempty"`
+	// SensitiveOverrides are applied like Overrides, but their values are
+	// masked in logs, events, status and errors.
+	// +optional
+	SensitiveOverrides []string `json:"sensitiveOverrides,omitempty"`
+	// ValuesFrom lists values files held in Secrets or ConfigMaps in the
+	// release namespace. They are applied in order, after Values. Values read
+	// from Secrets are masked in logs, events, status and errors. They are
+	// not watched: changes are rolled out at the next resync.
+	// +optional
+	ValuesFrom []ValuesReference `json:"valuesFrom,omitempty"`
+	// Timeout bounds each helm operation on this release, including --wait.
+	// Defaults to 5 minutes.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Retry controls how failed operations on this release are retried.
+	// +optional
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// DeletionPolicy decides what happens to the helm release when the
+	// HelmRelease is deleted. Defaults to Purge.
+	// +kubebuilder:validation:Enum=Purge;Retain
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// DeletionPolicy decides what happens to a helm release when its HelmRelease
+// is deleted.
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyPurge deletes the release and its history.
+	DeletionPolicyPurge DeletionPolicy = "Purge"
+	// DeletionPolicyRetain leaves the release installed and unmanaged.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// Defaults applied to HelmReleaseSpec by the defaulting webhook, and by the
+// controller to objects stored before the webhook existed.
+const (
+	DefaultTimeout              = 5 * time.Minute
+	DefaultMaxAttempts    int32 = 5
+	DefaultInitialBackoff       = 10 * time.Second
+	DefaultMaxBackoff           = 10 * time.Minute
+	DefaultDeletionPolicy       = DeletionPolicyPurge
+)
+
+// RetryPolicy controls exponential backoff between failed operations.
+type RetryPolicy struct {
+	// MaxAttempts is the number of consecutive failures after which the
+	// release is marked Stalled and no longer retried until its spec changes.
+	// Zero retries forever. Defaults to 5.
+	// +optional
+	MaxAttempts *int32 `json:"maxAttempts,omitempty"`
+	// InitialBackoff is the delay after the first failure. It doubles with
+	// every further failure. Defaults to 10 seconds.
+	// +optional
+	InitialBackoff *metav1.Duration `json:"initialBackoff,omitempty"`
+	// MaxBackoff caps the delay between attempts. Defaults to 10 minutes.
+	// +optional
+	MaxBackoff *metav1.Duration `json:"maxBackoff,omitempty"`
+}
+
+// ValuesReference selects a key holding a values file. Exactly one of
+// SecretKeyRef and ConfigMapKeyRef must be set.
+type ValuesReference struct {
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
 }
 
+// AdoptAnnotation, set to "true", allows a release to take over an existing
+// helm release of the same name which the operator did not install.
+const AdoptAnnotation = "operators.alexeldeib.xyz/adopt"
+
+// ShardLabel groups releases when the manager is sharded across replicas. Its
+// value, rather than the object's key, picks the shard, so releases sharing a
+// value are always handled by the same replica.
+const ShardLabel = "operators.alexeldeib.xyz/shard"
+
+// ConditionStalled is true when a release exhausted its retries and waits
+// for a spec change.
+const ConditionStalled ConditionType = "Stalled"
+
+// Provisioning states reported in HelmReleaseStatus.
+const (
+	ProvisioningStateDeploying = "Deploying"
+	ProvisioningStateSucceeded = "Succeeded"
+	ProvisioningStateFailed    = "Failed"
+)
+
 // HelmReleaseStatus defines the observed state of HelmRelease
 type HelmReleaseStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	ProvisioningState string `json:"provisioningState"`
+	// Revision is the helm revision last observed for this release.
+	// +optional
+	Revision int32 `json:"revision,omitempty"`
+	// AdoptedRevision is the revision an existing helm release was at when it
+	// was adopted, or zero if the operator installed it.
+	// +optional
+	AdoptedRevision int32 `json:"adoptedRevision,omitempty"`
+	// Message is a human readable description of the last operation.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// ObservedGeneration is the generation of the spec last acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastAppliedGeneration is the generation of the spec last deployed
+	// successfully. A failed upgrade which helm rolled back leaves a deployed
+	// release behind, so ObservedGeneration alone cannot tell whether the
+	// current spec is live.
+	// +optional
+	LastAppliedGeneration int64 `json:"lastAppliedGeneration,omitempty"`
+	// LastAppliedValuesHash identifies the versions of the Secrets and
+	// ConfigMaps in valuesFrom last deployed successfully, so that changes
+	// to them are rolled out although the spec is unchanged. It holds none
+	// of their content.
+	// +optional
+	LastAppliedValuesHash string `json:"lastAppliedValuesHash,omitempty"`
+	// Failures counts consecutive failed attempts for the current spec.
+	// +optional
+	Failures int32 `json:"failures,omitempty"`
+	// LastFailureTime is when the most recent attempt failed.
+	// +optional
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+	// LastFailureReason is a CamelCase reason for the most recent failure.
+	// +optional
+	LastFailureReason string `json:"lastFailureReason,omitempty"`
+	// NextRetryTime is the earliest time the next attempt will be made.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
 
 // HelmRelease is the Schema for the helmreleases API
 type HelmRelease struct {
@@ -60,6 +205,32 @@ type HelmReleaseList struct {
 	Items           []HelmRelease `json:"items"`
 }
 
+// GetReleaseName returns the name of the helm release managed by r.
+func (r *HelmRelease) GetReleaseName() string {
+	if r.Spec.ReleaseName != "" {
+		return r.Spec.ReleaseName
+	}
+	return r.Name
+}
+
+// GetTargetNamespace returns the namespace the chart of r is installed into.
+func (r *HelmRelease) GetTargetNamespace() string {
+	if r.Spec.TargetNamespace != "" {
+		return r.Spec.TargetNamespace
+	}
+	return r.Namespace
+}
+
+// GetReleaseSpec returns the spec of r.
+func (r *HelmRelease) GetReleaseSpec() *HelmReleaseSpec {
+	return &r.Spec
+}
+
+// GetReleaseStatus returns the status of r.
+func (r *HelmRelease) GetReleaseStatus() *HelmReleaseStatus {
+	return &r.Status
+}
+
 func init() {
 	SchemeBuilder.Register(&HelmRelease{}, &HelmReleaseList{})
 }
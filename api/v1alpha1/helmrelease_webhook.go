@@ -0,0 +1,242 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"net/url"
+	"regexp"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/helm/pkg/strvals"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/yaml"
+)
+
+// log is for logging in this package.
+var helmreleaselog = logf.Log.WithName("helmrelease-resource")
+
+// chartReference matches a chart in a configured repository, e.g.
+// stable/nginx-ingress.
+var chartReference = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*/[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SetupWebhookWithManager registers the HelmRelease webhooks with mgr.
+func (r *HelmRelease) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-operators-alexeldeib-xyz-v1alpha1-helmrelease,mutating=true,failurePolicy=fail,groups=operators.alexeldeib.xyz,resources=helmreleases,verbs=create;update,versions=v1alpha1,name=mhelmrelease.kb.io
+
+var _ webhook.Defaulter = &HelmRelease{}
+
+// Default implements webhook.Defaulter. Defaults are written into the stored
+// spec so that they show up on the object and a change of default in a later
+// version does not alter existing releases.
+func (r *HelmRelease) Default() {
+	helmreleaselog.Info("default", "name", r.Name)
+
+	// The name is not known yet for objects created with generateName; the
+	// controller falls back to it.
+	if r.Spec.ReleaseName == "" && r.Name != "" {
+		r.Spec.ReleaseName = r.Name
+	}
+	if r.Spec.TargetNamespace == "" && r.Namespace != "" {
+		r.Spec.TargetNamespace = r.Namespace
+	}
+	r.Spec.setDefaults()
+}
+
+// setDefaults fills in the defaults shared by HelmRelease and
+// ClusterHelmRelease.
+func (s *HelmReleaseSpec) setDefaults() {
+	if s.Timeout == nil {
+		s.Timeout = &metav1.Duration{Duration: DefaultTimeout}
+	}
+	if s.Retry == nil {
+		s.Retry = &RetryPolicy{}
+	}
+	if s.Retry.MaxAttempts == nil {
+		maxAttempts := DefaultMaxAttempts
+		s.Retry.MaxAttempts = &maxAttempts
+	}
+	if s.Retry.InitialBackoff == nil {
+		s.Retry.InitialBackoff = &metav1.Duration{Duration: DefaultInitialBackoff}
+	}
+	if s.Retry.MaxBackoff == nil {
+		s.Retry.MaxBackoff = &metav1.Duration{Duration: DefaultMaxBackoff}
+	}
+	if s.DeletionPolicy == "" {
+		s.DeletionPolicy = DefaultDeletionPolicy
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-operators-alexeldeib-xyz-v1alpha1-helmrelease,mutating=false,failurePolicy=fail,groups=operators.alexeldeib.xyz,resources=helmreleases,verbs=create;update,versions=v1alpha1,name=vhelmrelease.kb.io
+
+var _ webhook.Validator = &HelmRelease{}
+
+// ValidateCreate implements webhook.Validator.
+func (r *HelmRelease) ValidateCreate() error {
+	helmreleaselog.Info("validate create", "name", r.Name)
+
+	return r.toInvalid(r.validateSpec())
+}
+
+// ValidateUpdate implements webhook.Validator. The release name and target
+// namespace identify the helm release, so changing either would orphan it.
+// Objects being deleted and updates which leave the spec alone are not
+// validated, so that finalizers and metadata can always be removed.
+func (r *HelmRelease) ValidateUpdate(old runtime.Object) error {
+	helmreleaselog.Info("validate update", "name", r.Name)
+
+	previous, ok := old.(*HelmRelease)
+	if !r.DeletionTimestamp.IsZero() || ok && apiequality.Semantic.DeepEqual(r.Spec, previous.Spec) {
+		return nil
+	}
+	allErrs := r.validateSpec()
+	if ok {
+		allErrs = append(allErrs, validateReleaseIdentity(r, previous)...)
+	}
+	return r.toInvalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator.
+func (r *HelmRelease) ValidateDelete() error {
+	return nil
+}
+
+// validateSpec confines the release to the namespace of r; installing
+// elsewhere is what ClusterHelmRelease is for, and a namespaced object could
+// otherwise reach into namespaces its creator has no access to.
+func (r *HelmRelease) validateSpec() field.ErrorList {
+	allErrs := r.Spec.validate(r.GetReleaseName())
+	if r.Spec.TargetNamespace != "" && r.Namespace != "" && r.Spec.TargetNamespace != r.Namespace {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "targetNamespace"), r.Spec.TargetNamespace,
+			"must be the namespace of the HelmRelease; use a ClusterHelmRelease to install into another namespace"))
+	}
+	return allErrs
+}
+
+// validate checks the fields shared by HelmRelease and ClusterHelmRelease.
+// name is the effective release name.
+func (s *HelmReleaseSpec) validate(name string) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if err := validateChart(s.Chart); err != "" {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("chart"), s.Chart, err))
+	}
+
+	// Helm 2 stores releases in ConfigMaps named <release>.v<revision> and
+	// caps release names at 53 characters. The name is empty on create when
+	// generateName is used.
+	if len(name) > 53 {
+		allErrs = append(allErrs, field.TooLong(specPath.Child("releaseName"), name, 53))
+	} else if name != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(name) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("releaseName"), name, msg))
+		}
+	}
+
+	if s.TargetNamespace != "" {
+		for _, msg := range validation.IsDNS1123Label(s.TargetNamespace) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("targetNamespace"), s.TargetNamespace, msg))
+		}
+	}
+
+	if s.Values != "" {
+		var values map[string]interface{}
+		if err := yaml.Unmarshal([]byte(s.Values), &values); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("values"), "", "must be a YAML map: "+err.Error()))
+		}
+	}
+
+	for i, override := range s.Overrides {
+		if _, err := strvals.Parse(override); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("overrides").Index(i), override, err.Error()))
+		}
+	}
+	// Parse errors quote the input, so never echo a sensitive override back.
+	for i, override := range s.SensitiveOverrides {
+		if _, err := strvals.Parse(override); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("sensitiveOverrides").Index(i), "", "must be of the form key=value"))
+		}
+	}
+
+	for i, ref := range s.ValuesFrom {
+		if (ref.SecretKeyRef == nil) == (ref.ConfigMapKeyRef == nil) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("valuesFrom").Index(i), "", "exactly one of secretKeyRef or configMapKeyRef must be set"))
+		}
+	}
+
+	if s.Timeout != nil && s.Timeout.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("timeout"), s.Timeout.Duration.String(), "must be positive"))
+	}
+
+	return allErrs
+}
+
+func (r *HelmRelease) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("HelmRelease").GroupKind(), r.Name, allErrs)
+}
+
+// releaseIdentity is implemented by the kinds which manage a helm release.
+type releaseIdentity interface {
+	GetReleaseName() string
+	GetTargetNamespace() string
+}
+
+// validateReleaseIdentity forbids changing the release name or target
+// namespace, which identify the helm release; changing either would orphan it.
+func validateReleaseIdentity(r, previous releaseIdentity) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	if r.GetReleaseName() != previous.GetReleaseName() {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("releaseName"), "field is immutable"))
+	}
+	if r.GetTargetNamespace() != previous.GetTargetNamespace() {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("targetNamespace"), "field is immutable"))
+	}
+	return allErrs
+}
+
+// validateChart returns why chart is not a usable chart reference, or the
+// empty string if it is.
+func validateChart(chart string) string {
+	if chart == "" {
+		return "must not be empty"
+	}
+	if u, err := url.Parse(chart); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if u.Host == "" {
+			return "chart URL must have a host"
+		}
+		return ""
+	}
+	if !chartReference.MatchString(chart) {
+		return "must be a chart URL or of the form repository/chart"
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("HelmRelease webhook", func() {
+	var release *HelmRelease
+
+	BeforeEach(func() {
+		release = &HelmRelease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+			},
+			Spec: HelmReleaseSpec{
+				Chart:     "stable/nginx-ingress",
+				Values:    "controller:\n  replicaCount: 2\n",
+				Overrides: []string{"controller.service.loadBalancerIP=1.2.3.4"},
+			},
+		}
+	})
+
+	Context("Default", func() {
+		It("should write explicit defaults into the spec", func() {
+			release.Default()
+			Expect(release.Spec.ReleaseName).To(Equal("foo"))
+			Expect(release.Spec.TargetNamespace).To(Equal("default"))
+			Expect(release.Spec.Timeout.Duration).To(Equal(DefaultTimeout))
+			Expect(*release.Spec.Retry.MaxAttempts).To(Equal(DefaultMaxAttempts))
+			Expect(release.Spec.Retry.InitialBackoff.Duration).To(Equal(DefaultInitialBackoff))
+			Expect(release.Spec.Retry.MaxBackoff.Duration).To(Equal(DefaultMaxBackoff))
+			Expect(release.Spec.DeletionPolicy).To(Equal(DeletionPolicyPurge))
+			Expect(release.ValidateCreate()).To(Succeed())
+		})
+
+		It("should keep values which are already set", func() {
+			maxAttempts := int32(0)
+			release.Spec.ReleaseName = "bar"
+			release.Spec.Timeout = &metav1.Duration{Duration: time.Minute}
+			release.Spec.Retry = &RetryPolicy{MaxAttempts: &maxAttempts}
+			release.Spec.DeletionPolicy = DeletionPolicyRetain
+
+			release.Default()
+			Expect(release.Spec.ReleaseName).To(Equal("bar"))
+			Expect(release.Spec.Timeout.Duration).To(Equal(time.Minute))
+			Expect(*release.Spec.Retry.MaxAttempts).To(BeZero())
+			Expect(release.Spec.Retry.MaxBackoff.Duration).To(Equal(DefaultMaxBackoff))
+			Expect(release.Spec.DeletionPolicy).To(Equal(DeletionPolicyRetain))
+		})
+	})
+
+	Context("ValidateCreate", func() {
+		It("should accept a valid release", func() {
+			Expect(release.ValidateCreate()).To(Succeed())
+		})
+
+		It("should accept a chart URL", func() {
+			release.Spec.Chart = "https://example.com/charts/nginx-ingress-1.6.0.tgz"
+			Expect(release.ValidateCreate()).To(Succeed())
+		})
+
+		It("should reject a malformed chart reference", func() {
+			for _, chart := range []string{"", "nginx-ingress", "stable/nginx/ingress", "ftp://example.com/chart.tgz"} {
+				release.Spec.Chart = chart
+				Expect(release.ValidateCreate()).NotTo(Succeed(), chart)
+			}
+		})
+
+		It("should reject values that are not a YAML map", func() {
+			release.Spec.Values = "- a\n- b\n"
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+
+			release.Spec.Values = "controller: [\n"
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject malformed overrides", func() {
+			release.Spec.Overrides = []string{"controller.replicaCount"}
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should not echo malformed sensitive overrides", func() {
+			release.Spec.SensitiveOverrides = []string{"hunter2"}
+			err := release.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).NotTo(ContainSubstring("hunter2"))
+		})
+
+		It("should reject an invalid release name", func() {
+			release.Spec.ReleaseName = "Not_A_Name"
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject a target namespace other than its own", func() {
+			release.Spec.TargetNamespace = "kube-system"
+			Expect(release.ValidateCreate()).NotTo(Succeed())
+			release.Spec.TargetNamespace = "default"
+			Expect(release.ValidateCreate()).To(Succeed())
+		})
+	})
+
+	Context("ValidateUpdate", func() {
+		It("should accept changes to mutable fields", func() {
+			updated := release.DeepCopy()
+			updated.Spec.Values = "controller:\n  replicaCount: 3\n"
+			Expect(updated.ValidateUpdate(release)).To(Succeed())
+		})
+
+		It("should reject a release name change", func() {
+			updated := release.DeepCopy()
+			updated.Spec.ReleaseName = "bar"
+			Expect(updated.ValidateUpdate(release)).NotTo(Succeed())
+		})
+
+		It("should treat an explicit default release name as unchanged", func() {
+			updated := release.DeepCopy()
+			updated.Spec.ReleaseName = "foo"
+			Expect(updated.ValidateUpdate(release)).To(Succeed())
+		})
+
+		It("should reject a target namespace change", func() {
+			updated := release.DeepCopy()
+			updated.Spec.TargetNamespace = "kube-system"
+			Expect(updated.ValidateUpdate(release)).NotTo(Succeed())
+		})
+
+		It("should not validate an unchanged spec", func() {
+			release.Spec.Chart = "no-longer-valid"
+			updated := release.DeepCopy()
+			updated.Finalizers = nil
+			Expect(updated.ValidateUpdate(release)).To(Succeed())
+		})
+
+		It("should not validate an object being deleted", func() {
+			now := metav1.Now()
+			release.Spec.Chart = "no-longer-valid"
+			updated := release.DeepCopy()
+			updated.DeletionTimestamp = &now
+			updated.Spec.Values = "controller:\n  replicaCount: 3\n"
+			Expect(updated.ValidateUpdate(release)).To(Succeed())
+		})
+	})
+})
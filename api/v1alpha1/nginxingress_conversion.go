@@ -0,0 +1,192 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/alexeldeib/operators/api/v1beta1"
+)
+
+var _ conversion.Convertible = &NginxIngress{}
+
+// ConvertTo converts this NginxIngress to the hub version.
+func (src *NginxIngress) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.NginxIngress)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec.Azure = v1beta1.AzureLocation{
+		SubscriptionID: src.Spec.SubscriptionID,
+		ResourceGroup:  src.Spec.ResourceGroup,
+		Location:       src.Spec.Location,
+	}
+	dst.Spec.Chart = src.Spec.Chart
+	dst.Spec.Version = src.Spec.Version
+	dst.Spec.Values = src.Spec.Values.DeepCopy()
+	dst.Spec.Controller = convertNginxControllerTo(src.Spec.Controller)
+	dst.Spec.IngressClass = src.Spec.IngressClass
+	if lb := src.Spec.LoadBalancer; lb != nil {
+		dst.Spec.LoadBalancer = &v1beta1.NginxLoadBalancer{
+			Type:      v1beta1.NginxLoadBalancerType(lb.Type),
+			IPAddress: lb.IPAddress,
+			Subnet:    lb.Subnet,
+		}
+		if lb.PublicIPRef != nil {
+			ref := v1beta1.PublicIPReference(*lb.PublicIPRef)
+			dst.Spec.LoadBalancer.PublicIPRef = &ref
+		}
+	}
+	if src.Spec.Scope != nil {
+		scope := v1beta1.NginxScope(*src.Spec.Scope)
+		dst.Spec.Scope = &scope
+	}
+
+	// v1beta1 only has conditions. The booleans win if the two disagree,
+	// since older controllers only set the booleans.
+	conditions := convertConditionsTo(src.Status.Conditions)
+	conditions = mirrorBool(conditions, v1beta1.ConditionPublicIPReady, src.Status.PublicIPReady)
+	conditions = mirrorBool(conditions, v1beta1.ConditionReleaseReady, src.Status.HelmReleaseReady)
+	dst.Status.Conditions = conditions
+	dst.Status.IPAddress = src.Status.IPAddress
+	dst.Status.FQDN = src.Status.FQDN
+	dst.Status.IngressClass = src.Status.IngressClass
+
+	return nil
+}
+
+// ConvertFrom converts from the hub version to this version.
+func (dst *NginxIngress) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.NginxIngress)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec.SubscriptionID = src.Spec.Azure.SubscriptionID
+	dst.Spec.ResourceGroup = src.Spec.Azure.ResourceGroup
+	dst.Spec.Location = src.Spec.Azure.Location
+	dst.Spec.Chart = src.Spec.Chart
+	dst.Spec.Version = src.Spec.Version
+	dst.Spec.Values = src.Spec.Values.DeepCopy()
+	dst.Spec.Controller = convertNginxControllerFrom(src.Spec.Controller)
+	dst.Spec.IngressClass = src.Spec.IngressClass
+	if lb := src.Spec.LoadBalancer; lb != nil {
+		dst.Spec.LoadBalancer = &NginxLoadBalancer{
+			Type:      NginxLoadBalancerType(lb.Type),
+			IPAddress: lb.IPAddress,
+			Subnet:    lb.Subnet,
+		}
+		if lb.PublicIPRef != nil {
+			ref := PublicIPReference(*lb.PublicIPRef)
+			dst.Spec.LoadBalancer.PublicIPRef = &ref
+		}
+	}
+	if src.Spec.Scope != nil {
+		scope := NginxScope(*src.Spec.Scope)
+		dst.Spec.Scope = &scope
+	}
+
+	dst.Status.Conditions = convertConditionsFrom(src.Status.Conditions)
+	dst.Status.PublicIPReady = IsConditionTrue(dst.Status.Conditions, ConditionPublicIPReady)
+	dst.Status.HelmReleaseReady = IsConditionTrue(dst.Status.Conditions, ConditionReleaseReady)
+	dst.Status.IPAddress = src.Status.IPAddress
+	dst.Status.FQDN = src.Status.FQDN
+	dst.Status.IngressClass = src.Status.IngressClass
+
+	return nil
+}
+
+// mirrorBool makes the condition t in conditions agree with ready. A false
+// value with no condition is left alone, as absent and false mean the same.
+func mirrorBool(conditions []v1beta1.Condition, t v1beta1.ConditionType, ready bool) []v1beta1.Condition {
+	for i := range conditions {
+		if conditions[i].Type != t {
+			continue
+		}
+		if isTrue := conditions[i].Status == corev1.ConditionTrue; isTrue != ready {
+			conditions[i].Status = corev1.ConditionFalse
+			if ready {
+				conditions[i].Status = corev1.ConditionTrue
+			}
+		}
+		return conditions
+	}
+	if ready {
+		conditions = append(conditions, v1beta1.Condition{Type: t, Status: corev1.ConditionTrue})
+	}
+	return conditions
+}
+
+// convertNginxControllerTo converts src to the hub version. The settings are
+// laid out alike in both versions.
+func convertNginxControllerTo(src *NginxController) *v1beta1.NginxController {
+	if src == nil {
+		return nil
+	}
+	src = src.DeepCopy()
+	dst := &v1beta1.NginxController{
+		Replicas:     src.Replicas,
+		Resources:    src.Resources,
+		MinAvailable: src.MinAvailable,
+		NodeSelector: src.NodeSelector,
+		Tolerations:  src.Tolerations,
+		Affinity:     src.Affinity,
+		LogFormat:    v1beta1.NginxLogFormat(src.LogFormat),
+	}
+	if src.Autoscaling != nil {
+		autoscaling := v1beta1.NginxAutoscaling(*src.Autoscaling)
+		dst.Autoscaling = &autoscaling
+	}
+	if src.Config != nil {
+		config := v1beta1.NginxConfig(*src.Config)
+		dst.Config = &config
+	}
+	if src.Metrics != nil {
+		metrics := v1beta1.NginxMetrics(*src.Metrics)
+		dst.Metrics = &metrics
+	}
+	return dst
+}
+
+// convertNginxControllerFrom converts src from the hub version.
+func convertNginxControllerFrom(src *v1beta1.NginxController) *NginxController {
+	if src == nil {
+		return nil
+	}
+	src = src.DeepCopy()
+	dst := &NginxController{
+		Replicas:     src.Replicas,
+		Resources:    src.Resources,
+		MinAvailable: src.MinAvailable,
+		NodeSelector: src.NodeSelector,
+		Tolerations:  src.Tolerations,
+		Affinity:     src.Affinity,
+		LogFormat:    NginxLogFormat(src.LogFormat),
+	}
+	if src.Autoscaling != nil {
+		autoscaling := NginxAutoscaling(*src.Autoscaling)
+		dst.Autoscaling = &autoscaling
+	}
+	if src.Config != nil {
+		config := NginxConfig(*src.Config)
+		dst.Config = &config
+	}
+	if src.Metrics != nil {
+		metrics := NginxMetrics(*src.Metrics)
+		dst.Metrics = &metrics
+	}
+	return dst
+}
@@ -16,7 +16,12 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -29,8 +34,198 @@ type NginxIngressSpec struct {
 	SubscriptionID string `json:"subscriptionID"`
 	ResourceGroup  string `json:"resourceGroup"`
 	Location       string `json:"location"`
+	// Chart is the nginx-ingress chart to install. Defaults to the chart
+	// configured for the manager, stable/nginx-ingress unless changed.
+	// +optional
+	Chart string `json:"chart,omitempty"`
+	// Version pins the version of Chart. Defaults to the latest version.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// Values are chart values, as they would appear in a values file.
+	// Controller takes precedence over them, and the values set by the
+	// operator, such as controller.service.loadBalancerIP, over both; values
+	// replaced by the operator are reported by the ValuesOverridden
+	// condition.
+	// +optional
+	Values *runtime.RawExtension `json:"values,omitempty"`
+	// Controller configures the nginx ingress controller.
+	// +optional
+	Controller *NginxController `json:"controller,omitempty"`
+	// IngressClass is the class of the Ingresses the controller serves. No
+	// two NginxIngresses may claim the same class. Defaults to nginx.
+	// +optional
+	IngressClass string `json:"ingressClass,omitempty"`
+	// LoadBalancer configures the Azure load balancer of the controller.
+	// Defaults to a public load balancer.
+	// +optional
+	LoadBalancer *NginxLoadBalancer `json:"loadBalancer,omitempty"`
+	// Scope, if set, limits the controller to the Ingresses of a single
+	// namespace. Defaults to every namespace.
+	// +optional
+	Scope *NginxScope `json:"scope,omitempty"`
+}
+
+// DefaultNginxIngressChart is the chart installed when NginxIngressSpec.Chart
+// is empty.
+const DefaultNginxIngressChart = "stable/nginx-ingress"
+
+// DefaultIngressClass is the ingress class served when
+// NginxIngressSpec.IngressClass is empty.
+const DefaultIngressClass = "nginx"
+
+// NginxController holds the settings of the nginx ingress controller which
+// the operator translates into values of the nginx-ingress chart.
+type NginxController struct {
+	// Replicas is the number of controller pods. It may not be set with
+	// Autoscaling. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Resources are the compute resources of the controller container.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Autoscaling scales the controller pods with a HorizontalPodAutoscaler.
+	// +optional
+	Autoscaling *NginxAutoscaling `json:"autoscaling,omitempty"`
+	// MinAvailable is the number or percentage of controller pods kept
+	// running by a PodDisruptionBudget. The chart only creates the budget
+	// for more than one replica.
+	// +optional
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+	// NodeSelector constrains the nodes the controller pods run on.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations of the controller pods.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity of the controller pods.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// Config sets entries of the controller ConfigMap.
+	// +optional
+	Config *NginxConfig `json:"config,omitempty"`
+	// Metrics exposes the Prometheus metrics of the controller.
+	// +optional
+	Metrics *NginxMetrics `json:"metrics,omitempty"`
+	// LogFormat is the format of the access log. Defaults to Text, the
+	// combined log format of nginx.
+	// +kubebuilder:validation:Enum=Text;JSON
+	// +optional
+	LogFormat NginxLogFormat `json:"logFormat,omitempty"`
+}
+
+// NginxAutoscaling bounds the HorizontalPodAutoscaler of the controller pods.
+type NginxAutoscaling struct {
+	// +kubebuilder:validation:Minimum=1
+	MinReplicas int32 `json:"minReplicas"`
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+	// TargetCPUUtilizationPercentage defaults to 50.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+}
+
+// NginxConfig holds entries of the controller ConfigMap. Each field sets the
+// key named in its description.
+type NginxConfig struct {
+	// ProxyBodySize sets proxy-body-size, the largest request body accepted,
+	// e.g. 8m. 0 lifts the limit.
+	// +optional
+	ProxyBodySize string `json:"proxyBodySize,omitempty"`
+	// ProxyConnectTimeout sets proxy-connect-timeout, in whole seconds.
+	// +optional
+	ProxyConnectTimeout *metav1.Duration `json:"proxyConnectTimeout,omitempty"`
+	// ProxyReadTimeout sets proxy-read-timeout, in whole seconds.
+	// +optional
+	ProxyReadTimeout *metav1.Duration `json:"proxyReadTimeout,omitempty"`
+	// ProxySendTimeout sets proxy-send-timeout, in whole seconds.
+	// +optional
+	ProxySendTimeout *metav1.Duration `json:"proxySendTimeout,omitempty"`
+	// SSLProtocols sets ssl-protocols, the TLS versions accepted, e.g.
+	// TLSv1.2 and TLSv1.3.
+	// +optional
+	SSLProtocols []string `json:"sslProtocols,omitempty"`
+	// UseForwardedHeaders sets use-forwarded-headers, which trusts the
+	// X-Forwarded-* headers of requests. Only set it behind another proxy.
+	// +optional
+	UseForwardedHeaders *bool `json:"useForwardedHeaders,omitempty"`
+}
+
+// NginxMetrics controls the Prometheus metrics of the controller.
+type NginxMetrics struct {
+	// Enabled exposes the metrics on a Service of the release.
+	Enabled bool `json:"enabled"`
+	// ServiceMonitor creates a Prometheus Operator ServiceMonitor for the
+	// metrics. It requires Enabled.
+	// +optional
+	ServiceMonitor bool `json:"serviceMonitor,omitempty"`
+}
+
+// NginxLogFormat is the format of the nginx access log.
+type NginxLogFormat string
+
+const (
+	NginxLogFormatText NginxLogFormat = "Text"
+	NginxLogFormatJSON NginxLogFormat = "JSON"
+)
+
+// NginxLoadBalancer configures the Azure load balancer in front of the
+// controller.
+type NginxLoadBalancer struct {
+	// Type is Public, for a load balancer on a static public IP created by
+	// the operator, or Internal, for one on a private address of the
+	// virtual network of the cluster. Defaults to Public.
+	// +kubebuilder:validation:Enum=Public;Internal
+	// +optional
+	Type NginxLoadBalancerType `json:"type,omitempty"`
+	// IPAddress is the static private address of an Internal load balancer.
+	// Defaults to an address assigned by Azure.
+	// +optional
+	IPAddress string `json:"ipAddress,omitempty"`
+	// Subnet is the subnet of an Internal load balancer. Defaults to the
+	// subnet of the nodes.
+	// +optional
+	Subnet string `json:"subnet,omitempty"`
+	// PublicIPRef is an existing public IP for a Public load balancer, used
+	// instead of one created by the operator. The operator neither owns nor
+	// deletes it.
+	// +optional
+	PublicIPRef *PublicIPReference `json:"publicIPRef,omitempty"`
 }
 
+// NginxScope limits the namespaces watched by the controller.
+type NginxScope struct {
+	// Namespace is the only namespace whose Ingresses the controller serves.
+	// Defaults to the namespace of the NginxIngress.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// PublicIPReference names an existing public IP by exactly one of Name and
+// ResourceID.
+type PublicIPReference struct {
+	// Name is the name of a PublicIP in the namespace of the NginxIngress.
+	// It must not be controlled by another object, such as another
+	// NginxIngress.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// ResourceID is the Azure resource ID of a public IP which has no
+	// PublicIP object, e.g. /subscriptions/<subscription>/resourceGroups/<group>/providers/Microsoft.Network/publicIPAddresses/<name>.
+	// Its address is only known once the load balancer reports it.
+	// +optional
+	ResourceID string `json:"resourceID,omitempty"`
+}
+
+// NginxLoadBalancerType is the type of the Azure load balancer.
+type NginxLoadBalancerType string
+
+const (
+	NginxLoadBalancerPublic   NginxLoadBalancerType = "Public"
+	NginxLoadBalancerInternal NginxLoadBalancerType = "Internal"
+)
+
 // NginxIngressStatus defines the observed state of NginxIngress
 type NginxIngressStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -39,10 +234,52 @@ type NginxIngressStatus struct {
 	PublicIPReady bool `json:"publicIPReady,omitempty"`
 	// +optional
 	HelmReleaseReady bool `json:"helmReleaseReady,omitempty"`
+	// IPAddress is the address the ingress controller is reachable on; a
+	// private one for an Internal load balancer.
+	// +optional
+	IPAddress string `json:"ipAddress,omitempty"`
+	// FQDN is the Azure DNS name of IPAddress, given by the domain name label
+	// of its public IP.
+	// +optional
+	FQDN string `json:"fqdn,omitempty"`
+	// IngressClass is the class of the Ingresses served by the controller.
+	// +optional
+	IngressClass string `json:"ingressClass,omitempty"`
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
+// Condition types reported in NginxIngressStatus. PublicIPReady and
+// ReleaseReady mirror the boolean fields of the same name. LoadBalancerReady
+// is true once the load balancer answers on the public IP, and Ready once all
+// three are.
+const (
+	ConditionPublicIPReady     ConditionType = "PublicIPReady"
+	ConditionReleaseReady      ConditionType = "ReleaseReady"
+	ConditionLoadBalancerReady ConditionType = "LoadBalancerReady"
+	ConditionReady             ConditionType = "Ready"
+	// ConditionWaitingForPublicIP is true while the nginx release is held
+	// back until the public IP is allocated. Its reason turns to Timeout or
+	// ProvisioningFailed when the allocation fails.
+	ConditionWaitingForPublicIP ConditionType = "WaitingForPublicIP"
+	// ConditionTerminating is true while a deleted NginxIngress tears down
+	// its children. Its reason names the step being waited on.
+	ConditionTerminating ConditionType = "Terminating"
+	// ConditionValuesOverridden is true while spec.values sets values which
+	// the operator replaces with its own.
+	ConditionValuesOverridden ConditionType = "ValuesOverridden"
+	// ConditionIngressClassConflict is true while another NginxIngress holds
+	// the ingress class; nothing is deployed until it is released.
+	ConditionIngressClassConflict ConditionType = "IngressClassConflict"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Class",type=string,JSONPath=`.status.ingressClass`
+// +kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.status.ipAddress`
+// +kubebuilder:printcolumn:name="FQDN",type=string,JSONPath=`.status.fqdn`,priority=1
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // NginxIngress is the Schema for the nginxingresses API
 type NginxIngress struct {
@@ -62,6 +299,42 @@ type NginxIngressList struct {
 	Items           []NginxIngress `json:"items"`
 }
 
+// GetIngressClass returns the ingress class served by r.
+func (r *NginxIngress) GetIngressClass() string {
+	if r.Spec.IngressClass != "" {
+		return r.Spec.IngressClass
+	}
+	return DefaultIngressClass
+}
+
+// IsInternal reports whether r is served by an internal load balancer, which
+// has no public IP.
+func (r *NginxIngress) IsInternal() bool {
+	return r.Spec.LoadBalancer != nil && r.Spec.LoadBalancer.Type == NginxLoadBalancerInternal
+}
+
+// GetPublicIPRef returns the existing public IP r uses, or nil if the
+// operator creates one, or r has none.
+func (r *NginxIngress) GetPublicIPRef() *PublicIPReference {
+	if r.Spec.LoadBalancer == nil || r.IsInternal() {
+		return nil
+	}
+	return r.Spec.LoadBalancer.PublicIPRef
+}
+
+// publicIPResourceID matches the Azure resource ID of a public IP.
+var publicIPResourceID = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Network/publicIPAddresses/([^/]+)$`)
+
+// ParsePublicIPResourceID splits the Azure resource ID of a public IP. It
+// reports false if id is not one.
+func ParsePublicIPResourceID(id string) (subscriptionID, resourceGroup, name string, ok bool) {
+	match := publicIPResourceID.FindStringSubmatch(id)
+	if match == nil {
+		return "", "", "", false
+	}
+	return match[1], match[2], match[3], true
+}
+
 func init() {
 	SchemeBuilder.Register(&NginxIngress{}, &NginxIngressList{})
 }
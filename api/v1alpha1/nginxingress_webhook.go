@@ -0,0 +1,385 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var nginxingresslog = logf.Log.WithName("nginxingress-resource")
+
+var (
+	// subscriptionID matches an Azure subscription GUID.
+	subscriptionID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	// location matches an Azure region name as used by the ARM API, e.g.
+	// westus2.
+	location = regexp.MustCompile(`^[a-z0-9]+$`)
+	// resourceGroup matches the characters Azure allows in a resource group
+	// name.
+	resourceGroup = regexp.MustCompile(`^[-\w._()]+$`)
+	// proxyBodySize matches an nginx size, e.g. 8m.
+	proxyBodySize = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	// sslProtocols are the TLS versions nginx accepts in ssl-protocols.
+	sslProtocols = map[string]bool{"TLSv1": true, "TLSv1.1": true, "TLSv1.2": true, "TLSv1.3": true}
+	// subnet matches an Azure subnet name.
+	subnet = regexp.MustCompile(`^[a-zA-Z0-9]([-\w.]{0,78}\w)?$`)
+)
+
+// nginxIngressReader lists NginxIngresses to find the holder of an ingress
+// class. It is set by SetNginxIngressReader; while unset, claims are not
+// checked.
+var nginxIngressReader client.Reader
+
+// SetNginxIngressReader sets the reader with which the validating webhook
+// finds the holder of an ingress class. It must read from the API server
+// rather than the manager's cache, which may be stale or limited to the
+// namespaces the operator manages, so that claims from anywhere in the
+// cluster are seen.
+func SetNginxIngressReader(reader client.Reader) {
+	nginxIngressReader = reader
+}
+
+// SetupWebhookWithManager registers the NginxIngress webhooks with mgr.
+func (r *NginxIngress) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-operators-alexeldeib-xyz-v1alpha1-nginxingress,mutating=true,failurePolicy=fail,groups=operators.alexeldeib.xyz,resources=nginxingresses,verbs=create;update,versions=v1alpha1,name=mnginxingress.kb.io
+
+var _ webhook.Defaulter = &NginxIngress{}
+
+// Default implements webhook.Defaulter. Defaults are stored rather than
+// applied when read, so that changing one does not change existing objects.
+func (r *NginxIngress) Default() {
+	nginxingresslog.Info("default", "name", r.Name)
+
+	if r.Spec.Chart == "" {
+		r.Spec.Chart = defaultNginxIngressChart()
+	}
+	if r.Spec.IngressClass == "" {
+		r.Spec.IngressClass = DefaultIngressClass
+	}
+	if r.Spec.LoadBalancer == nil {
+		r.Spec.LoadBalancer = &NginxLoadBalancer{}
+	}
+	if r.Spec.LoadBalancer.Type == "" {
+		r.Spec.LoadBalancer.Type = NginxLoadBalancerPublic
+	}
+}
+
+// nginxIngressChart is the chart stored by Default, when set.
+var nginxIngressChart atomic.Value
+
+// SetDefaultNginxIngressChart replaces DefaultNginxIngressChart as the chart
+// stored by the defaulting webhook. It is safe to call while serving.
+func SetDefaultNginxIngressChart(chart string) {
+	nginxIngressChart.Store(chart)
+}
+
+func defaultNginxIngressChart() string {
+	if chart, ok := nginxIngressChart.Load().(string); ok && chart != "" {
+		return chart
+	}
+	return DefaultNginxIngressChart
+}
+
+// +kubebuilder:webhook:path=/validate-operators-alexeldeib-xyz-v1alpha1-nginxingress,mutating=false,failurePolicy=fail,groups=operators.alexeldeib.xyz,resources=nginxingresses,verbs=create;update,versions=v1alpha1,name=vnginxingress.kb.io
+
+var _ webhook.Validator = &NginxIngress{}
+
+// ValidateCreate implements webhook.Validator.
+func (r *NginxIngress) ValidateCreate() error {
+	nginxingresslog.Info("validate create", "name", r.Name)
+
+	allErrs := r.validateSpec()
+	allErrs = append(allErrs, r.validateIngressClassClaim()...)
+	return r.toInvalid(allErrs)
+}
+
+// ValidateUpdate implements webhook.Validator. Objects being deleted and
+// updates which leave the spec alone are not validated, so that finalizers
+// and metadata can always be removed. The ingress class claim is only checked
+// when the class changes, so that an object which already shares its class
+// can still be fixed.
+func (r *NginxIngress) ValidateUpdate(old runtime.Object) error {
+	nginxingresslog.Info("validate update", "name", r.Name)
+
+	previous, ok := old.(*NginxIngress)
+	if !r.DeletionTimestamp.IsZero() || ok && apiequality.Semantic.DeepEqual(r.Spec, previous.Spec) {
+		return nil
+	}
+	allErrs := r.validateSpec()
+	if !ok || previous.GetIngressClass() != r.GetIngressClass() {
+		allErrs = append(allErrs, r.validateIngressClassClaim()...)
+	}
+	return r.toInvalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator.
+func (r *NginxIngress) ValidateDelete() error {
+	return nil
+}
+
+func (r *NginxIngress) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if !subscriptionID.MatchString(r.Spec.SubscriptionID) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("subscriptionID"), r.Spec.SubscriptionID, "must be a subscription GUID"))
+	}
+
+	if !location.MatchString(r.Spec.Location) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("location"), r.Spec.Location, "must be an Azure region name such as westus2"))
+	}
+
+	switch group := r.Spec.ResourceGroup; {
+	case len(group) == 0 || len(group) > 90:
+		allErrs = append(allErrs, field.Invalid(specPath.Child("resourceGroup"), group, "must be between 1 and 90 characters"))
+	case !resourceGroup.MatchString(group) || strings.HasSuffix(group, "."):
+		allErrs = append(allErrs, field.Invalid(specPath.Child("resourceGroup"), group, "may only contain alphanumerics, underscores, hyphens, periods and parentheses, and may not end in a period"))
+	}
+
+	if r.Spec.Values != nil && len(r.Spec.Values.Raw) > 0 {
+		var values map[string]interface{}
+		if err := json.Unmarshal(r.Spec.Values.Raw, &values); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("values"), "", "must be an object: "+err.Error()))
+		}
+	}
+
+	if class := r.Spec.IngressClass; class != "" {
+		for _, msg := range validation.IsDNS1123Label(class) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("ingressClass"), class, msg))
+		}
+	}
+
+	if r.Spec.Controller != nil {
+		allErrs = append(allErrs, validateNginxController(specPath.Child("controller"), r.Spec.Controller)...)
+	}
+
+	if r.Spec.LoadBalancer != nil {
+		allErrs = append(allErrs, validateNginxLoadBalancer(specPath.Child("loadBalancer"), r.Spec.LoadBalancer)...)
+	}
+
+	if scope := r.Spec.Scope; scope != nil && scope.Namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(scope.Namespace) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("scope", "namespace"), scope.Namespace, msg))
+		}
+	}
+
+	return allErrs
+}
+
+// validateIngressClassClaim rejects r if another NginxIngress already claims
+// its ingress class, as both controllers would serve every Ingress of it.
+func (r *NginxIngress) validateIngressClassClaim() field.ErrorList {
+	if nginxIngressReader == nil {
+		return nil
+	}
+	path := field.NewPath("spec", "ingressClass")
+	var list NginxIngressList
+	if err := nginxIngressReader.List(context.Background(), &list); err != nil {
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	class := r.GetIngressClass()
+	for _, other := range list.Items {
+		if other.Namespace == r.Namespace && other.Name == r.Name {
+			continue
+		}
+		if other.GetIngressClass() == class {
+			return field.ErrorList{field.Invalid(path, class,
+				fmt.Sprintf("is already claimed by NginxIngress %s/%s", other.Namespace, other.Name))}
+		}
+	}
+	return nil
+}
+
+// validateNginxController checks the settings which the chart would accept
+// but nginx or the cluster would not.
+func validateNginxController(path *field.Path, c *NginxController) field.ErrorList {
+	var allErrs field.ErrorList
+
+	replicas := int32(1)
+	if c.Replicas != nil {
+		replicas = *c.Replicas
+		if replicas < 1 {
+			allErrs = append(allErrs, field.Invalid(path.Child("replicas"), replicas, "must be at least 1"))
+		}
+		if c.Autoscaling != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("replicas"), "may not be set with autoscaling"))
+		}
+	}
+	if a := c.Autoscaling; a != nil {
+		replicas = a.MinReplicas
+		if a.MinReplicas < 1 {
+			allErrs = append(allErrs, field.Invalid(path.Child("autoscaling", "minReplicas"), a.MinReplicas, "must be at least 1"))
+		}
+		if a.MaxReplicas < a.MinReplicas {
+			allErrs = append(allErrs, field.Invalid(path.Child("autoscaling", "maxReplicas"), a.MaxReplicas, "must not be less than minReplicas"))
+		}
+		if t := a.TargetCPUUtilizationPercentage; t != nil && (*t < 1 || *t > 100) {
+			allErrs = append(allErrs, field.Invalid(path.Child("autoscaling", "targetCPUUtilizationPercentage"), *t, "must be between 1 and 100"))
+		}
+	}
+
+	if c.MinAvailable != nil {
+		minAvailable, err := intstr.GetValueFromIntOrPercent(c.MinAvailable, int(replicas), true)
+		switch {
+		case err != nil:
+			allErrs = append(allErrs, field.Invalid(path.Child("minAvailable"), c.MinAvailable.String(), "must be a number or a percentage"))
+		case minAvailable < 0:
+			allErrs = append(allErrs, field.Invalid(path.Child("minAvailable"), c.MinAvailable.String(), "must not be negative"))
+		case replicas > 1 && minAvailable >= int(replicas):
+			allErrs = append(allErrs, field.Invalid(path.Child("minAvailable"), c.MinAvailable.String(), "must leave at least one replica to evict, or no node could be drained"))
+		}
+	}
+
+	if res := c.Resources; res != nil {
+		for name, limit := range res.Limits {
+			if request, ok := res.Requests[name]; ok && request.Cmp(limit) > 0 {
+				allErrs = append(allErrs, field.Invalid(path.Child("resources", "requests").Key(string(name)), request.String(), "must not exceed the limit"))
+			}
+		}
+	}
+
+	if config := c.Config; config != nil {
+		configPath := path.Child("config")
+		if config.ProxyBodySize != "" && !proxyBodySize.MatchString(config.ProxyBodySize) {
+			allErrs = append(allErrs, field.Invalid(configPath.Child("proxyBodySize"), config.ProxyBodySize, "must be a size in bytes, optionally suffixed with k, m or g, e.g. 8m"))
+		}
+		allErrs = append(allErrs, validateSeconds(configPath.Child("proxyConnectTimeout"), config.ProxyConnectTimeout)...)
+		allErrs = append(allErrs, validateSeconds(configPath.Child("proxyReadTimeout"), config.ProxyReadTimeout)...)
+		allErrs = append(allErrs, validateSeconds(configPath.Child("proxySendTimeout"), config.ProxySendTimeout)...)
+		seen := map[string]bool{}
+		for i, protocol := range config.SSLProtocols {
+			switch {
+			case !sslProtocols[protocol]:
+				allErrs = append(allErrs, field.NotSupported(configPath.Child("sslProtocols").Index(i), protocol, []string{"TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}))
+			case seen[protocol]:
+				allErrs = append(allErrs, field.Duplicate(configPath.Child("sslProtocols").Index(i), protocol))
+			}
+			seen[protocol] = true
+		}
+	}
+
+	if m := c.Metrics; m != nil && m.ServiceMonitor && !m.Enabled {
+		allErrs = append(allErrs, field.Invalid(path.Child("metrics", "serviceMonitor"), m.ServiceMonitor, "requires enabled"))
+	}
+
+	switch c.LogFormat {
+	case "", NginxLogFormatText, NginxLogFormatJSON:
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("logFormat"), c.LogFormat, []string{string(NginxLogFormatText), string(NginxLogFormatJSON)}))
+	}
+
+	return allErrs
+}
+
+// validateNginxLoadBalancer checks that the private address and subnet are
+// only set for an Internal load balancer, the public IP reference only for a
+// Public one, and that they are well formed.
+func validateNginxLoadBalancer(path *field.Path, lb *NginxLoadBalancer) field.ErrorList {
+	var allErrs field.ErrorList
+
+	switch lb.Type {
+	case "", NginxLoadBalancerPublic:
+		if lb.IPAddress != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("ipAddress"), "may only be set for an Internal load balancer"))
+		}
+		if lb.Subnet != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("subnet"), "may only be set for an Internal load balancer"))
+		}
+		if lb.PublicIPRef != nil {
+			allErrs = append(allErrs, validatePublicIPReference(path.Child("publicIPRef"), lb.PublicIPRef)...)
+		}
+		return allErrs
+	case NginxLoadBalancerInternal:
+		if lb.PublicIPRef != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("publicIPRef"), "may only be set for a Public load balancer"))
+		}
+	default:
+		return field.ErrorList{field.NotSupported(path.Child("type"), lb.Type, []string{string(NginxLoadBalancerPublic), string(NginxLoadBalancerInternal)})}
+	}
+
+	if lb.IPAddress != "" {
+		if ip := net.ParseIP(lb.IPAddress); ip == nil || ip.To4() == nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("ipAddress"), lb.IPAddress, "must be an IPv4 address"))
+		}
+	}
+	if lb.Subnet != "" && !subnet.MatchString(lb.Subnet) {
+		allErrs = append(allErrs, field.Invalid(path.Child("subnet"), lb.Subnet, "must be an Azure subnet name: up to 80 alphanumerics, underscores, hyphens and periods, starting with an alphanumeric and ending with an alphanumeric or underscore"))
+	}
+	return allErrs
+}
+
+// validatePublicIPReference checks that ref names a public IP in exactly one
+// way.
+func validatePublicIPReference(path *field.Path, ref *PublicIPReference) field.ErrorList {
+	var allErrs field.ErrorList
+	switch {
+	case ref.Name == "" && ref.ResourceID == "":
+		allErrs = append(allErrs, field.Required(path, "one of name and resourceID must be set"))
+	case ref.Name != "" && ref.ResourceID != "":
+		allErrs = append(allErrs, field.Forbidden(path.Child("resourceID"), "may not be set with name"))
+	case ref.Name != "":
+		for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+			allErrs = append(allErrs, field.Invalid(path.Child("name"), ref.Name, msg))
+		}
+	default:
+		if _, _, _, ok := ParsePublicIPResourceID(ref.ResourceID); !ok {
+			allErrs = append(allErrs, field.Invalid(path.Child("resourceID"), ref.ResourceID,
+				"must be the Azure resource ID of a public IP, /subscriptions/<subscription>/resourceGroups/<group>/providers/Microsoft.Network/publicIPAddresses/<name>"))
+		}
+	}
+	return allErrs
+}
+
+// validateSeconds checks that an optional nginx timeout is a whole number of
+// seconds, as nginx takes it.
+func validateSeconds(path *field.Path, timeout *metav1.Duration) field.ErrorList {
+	if timeout == nil || (timeout.Duration >= time.Second && timeout.Duration%time.Second == 0) {
+		return nil
+	}
+	return field.ErrorList{field.Invalid(path, timeout.Duration.String(), "must be a whole number of seconds, at least 1s")}
+}
+
+func (r *NginxIngress) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("NginxIngress").GroupKind(), r.Name, allErrs)
+}
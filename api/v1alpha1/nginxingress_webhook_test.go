@@ -0,0 +1,312 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("NginxIngress webhook", func() {
+	var ingress *NginxIngress
+
+	BeforeEach(func() {
+		ingress = &NginxIngress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+			},
+			Spec: NginxIngressSpec{
+				SubscriptionID: "00000000-0000-0000-0000-000000000000",
+				ResourceGroup:  "my-rg_1.(test)",
+				Location:       "westus2",
+			},
+		}
+	})
+
+	It("should default the chart", func() {
+		ingress.Default()
+		Expect(ingress.Spec.Chart).To(Equal(DefaultNginxIngressChart))
+
+		ingress.Spec.Chart = "myrepo/nginx-ingress"
+		ingress.Default()
+		Expect(ingress.Spec.Chart).To(Equal("myrepo/nginx-ingress"))
+	})
+
+	It("should store the ingress class and load balancer type", func() {
+		ingress.Default()
+		Expect(ingress.Spec.IngressClass).To(Equal(DefaultIngressClass))
+		Expect(ingress.Spec.LoadBalancer).To(Equal(&NginxLoadBalancer{Type: NginxLoadBalancerPublic}))
+
+		ingress.Spec.IngressClass = "internal"
+		ingress.Spec.LoadBalancer = &NginxLoadBalancer{Type: NginxLoadBalancerInternal, Subnet: "ingress"}
+		ingress.Default()
+		Expect(ingress.Spec.IngressClass).To(Equal("internal"))
+		Expect(ingress.Spec.LoadBalancer.Type).To(Equal(NginxLoadBalancerInternal))
+	})
+
+	It("should accept a valid spec", func() {
+		Expect(ingress.ValidateCreate()).To(Succeed())
+		Expect(ingress.ValidateUpdate(ingress.DeepCopy())).To(Succeed())
+	})
+
+	It("should not validate an unchanged spec or an object being deleted", func() {
+		ingress.Spec.SubscriptionID = "not-a-guid"
+		updated := ingress.DeepCopy()
+		Expect(updated.ValidateUpdate(ingress)).To(Succeed())
+
+		now := metav1.Now()
+		updated.DeletionTimestamp = &now
+		updated.Spec.Location = "West US 2"
+		Expect(updated.ValidateUpdate(ingress)).To(Succeed())
+
+		updated.DeletionTimestamp = nil
+		Expect(updated.ValidateUpdate(ingress)).NotTo(Succeed())
+	})
+
+	It("should reject a malformed subscription ID", func() {
+		ingress.Spec.SubscriptionID = "not-a-guid"
+		Expect(ingress.ValidateCreate()).NotTo(Succeed())
+	})
+
+	It("should reject a malformed location", func() {
+		for _, location := range []string{"", "West US 2", "west-us"} {
+			ingress.Spec.Location = location
+			Expect(ingress.ValidateCreate()).NotTo(Succeed(), location)
+		}
+	})
+
+	It("should reject a malformed resource group", func() {
+		for _, group := range []string{"", "rg.", "rg/1"} {
+			ingress.Spec.ResourceGroup = group
+			Expect(ingress.ValidateCreate()).NotTo(Succeed(), group)
+		}
+	})
+
+	Context("when another NginxIngress claims the ingress class", func() {
+		BeforeEach(func() {
+			s := runtime.NewScheme()
+			Expect(AddToScheme(s)).To(Succeed())
+			objs := []runtime.Object{&NginxIngress{
+				ObjectMeta: metav1.ObjectMeta{Name: "public", Namespace: "edge"},
+			}}
+			SetNginxIngressReader(fake.NewFakeClientWithScheme(s, objs...))
+		})
+
+		AfterEach(func() {
+			SetNginxIngressReader(nil)
+		})
+
+		It("should reject a second claim", func() {
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.IngressClass = "internal"
+			Expect(ingress.ValidateCreate()).To(Succeed())
+		})
+
+		It("should let the holder be updated", func() {
+			ingress.Name, ingress.Namespace = "public", "edge"
+			old := ingress.DeepCopy()
+			old.Spec.IngressClass = "internal"
+			Expect(ingress.ValidateUpdate(old)).To(Succeed())
+		})
+
+		It("should reject a change to the claimed class", func() {
+			old := ingress.DeepCopy()
+			old.Spec.IngressClass = "internal"
+			Expect(ingress.ValidateUpdate(old)).NotTo(Succeed())
+		})
+
+		It("should not check the claim when the class is unchanged", func() {
+			old := ingress.DeepCopy()
+			ingress.Spec.Location = "eastus"
+			Expect(ingress.ValidateUpdate(old)).To(Succeed())
+		})
+	})
+
+	It("should accept only a namespace name as the scope", func() {
+		ingress.Spec.Scope = &NginxScope{}
+		Expect(ingress.ValidateCreate()).To(Succeed())
+
+		ingress.Spec.Scope.Namespace = "apps"
+		Expect(ingress.ValidateCreate()).To(Succeed())
+
+		ingress.Spec.Scope.Namespace = "Apps/Team"
+		Expect(ingress.ValidateCreate()).NotTo(Succeed())
+	})
+
+	It("should reject an ingress class which is not a DNS label", func() {
+		ingress.Spec.IngressClass = "Internal_LB"
+		Expect(ingress.ValidateCreate()).NotTo(Succeed())
+	})
+
+	It("should accept only an object as values", func() {
+		ingress.Spec.Values = &runtime.RawExtension{Raw: []byte(`{"controller":{"replicaCount":2}}`)}
+		Expect(ingress.ValidateCreate()).To(Succeed())
+
+		ingress.Spec.Values = &runtime.RawExtension{Raw: []byte(`["controller"]`)}
+		Expect(ingress.ValidateCreate()).NotTo(Succeed())
+	})
+
+	Context("with an internal load balancer", func() {
+		BeforeEach(func() {
+			ingress.Spec.LoadBalancer = &NginxLoadBalancer{
+				Type:      NginxLoadBalancerInternal,
+				IPAddress: "10.240.0.42",
+				Subnet:    "ingress-subnet",
+			}
+		})
+
+		It("should accept a static private address and subnet", func() {
+			Expect(ingress.ValidateCreate()).To(Succeed())
+		})
+
+		It("should reject a malformed address or subnet", func() {
+			ingress.Spec.LoadBalancer.IPAddress = "10.240.0"
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.LoadBalancer.IPAddress = "fd00::42"
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.LoadBalancer.IPAddress = ""
+			ingress.Spec.LoadBalancer.Subnet = "ingress/subnet"
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject a private address for a public load balancer", func() {
+			ingress.Spec.LoadBalancer.Type = NginxLoadBalancerPublic
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.LoadBalancer.IPAddress = ""
+			ingress.Spec.LoadBalancer.Subnet = ""
+			Expect(ingress.ValidateCreate()).To(Succeed())
+		})
+	})
+
+	Context("with a public IP reference", func() {
+		BeforeEach(func() {
+			ingress.Spec.LoadBalancer = &NginxLoadBalancer{
+				PublicIPRef: &PublicIPReference{Name: "partner-ip"},
+			}
+		})
+
+		It("should accept a PublicIP name or an Azure resource ID", func() {
+			Expect(ingress.ValidateCreate()).To(Succeed())
+
+			ingress.Spec.LoadBalancer.PublicIPRef = &PublicIPReference{
+				ResourceID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/static-ips/providers/Microsoft.Network/publicIPAddresses/partner-ip",
+			}
+			Expect(ingress.ValidateCreate()).To(Succeed())
+		})
+
+		It("should reject a reference which is empty, ambiguous or malformed", func() {
+			ingress.Spec.LoadBalancer.PublicIPRef = &PublicIPReference{}
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.LoadBalancer.PublicIPRef = &PublicIPReference{
+				Name:       "partner-ip",
+				ResourceID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/static-ips/providers/Microsoft.Network/publicIPAddresses/partner-ip",
+			}
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.LoadBalancer.PublicIPRef = &PublicIPReference{
+				ResourceID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/static-ips/providers/Microsoft.Network/loadBalancers/kubernetes",
+			}
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject a reference for an internal load balancer", func() {
+			ingress.Spec.LoadBalancer.Type = NginxLoadBalancerInternal
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+	})
+
+	Context("with controller settings", func() {
+		var replicas int32
+
+		BeforeEach(func() {
+			replicas = 3
+			minAvailable := intstr.FromInt(2)
+			ingress.Spec.Controller = &NginxController{
+				Replicas:     &replicas,
+				MinAvailable: &minAvailable,
+				Resources: &corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+					Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+				Config: &NginxConfig{
+					ProxyBodySize:    "8m",
+					ProxyReadTimeout: &metav1.Duration{Duration: 2 * time.Minute},
+					SSLProtocols:     []string{"TLSv1.2", "TLSv1.3"},
+				},
+				Metrics:   &NginxMetrics{Enabled: true, ServiceMonitor: true},
+				LogFormat: NginxLogFormatJSON,
+			}
+		})
+
+		It("should accept valid settings", func() {
+			Expect(ingress.ValidateCreate()).To(Succeed())
+		})
+
+		It("should reject replicas with autoscaling", func() {
+			ingress.Spec.Controller.Autoscaling = &NginxAutoscaling{MinReplicas: 3, MaxReplicas: 5}
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.Controller.Replicas = nil
+			Expect(ingress.ValidateCreate()).To(Succeed())
+			ingress.Spec.Controller.Autoscaling.MaxReplicas = 1
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject a disruption budget which blocks every eviction", func() {
+			minAvailable := intstr.FromString("100%")
+			ingress.Spec.Controller.MinAvailable = &minAvailable
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject requests above limits", func() {
+			ingress.Spec.Controller.Resources.Requests[corev1.ResourceCPU] = resource.MustParse("2")
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject config nginx would not accept", func() {
+			ingress.Spec.Controller.Config.ProxyBodySize = "8 MB"
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.Controller.Config.ProxyBodySize = ""
+			ingress.Spec.Controller.Config.ProxyReadTimeout.Duration = 1500 * time.Millisecond
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+
+			ingress.Spec.Controller.Config.ProxyReadTimeout = nil
+			ingress.Spec.Controller.Config.SSLProtocols = []string{"SSLv3"}
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("should reject a ServiceMonitor without metrics", func() {
+			ingress.Spec.Controller.Metrics.Enabled = false
+			Expect(ingress.ValidateCreate()).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,51 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// ClusterHelmReleaseReconciler reconciles a ClusterHelmRelease object. It has
+// the same fields as HelmReleaseReconciler and runs the same engine.
+type ClusterHelmReleaseReconciler HelmReleaseReconciler
+
+// +kubebuilder:rbac:groups=operators.alexeldeib.xyz,resources=clusterhelmreleases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=operators.alexeldeib.xyz,resources=clusterhelmreleases/status,verbs=get;update;patch
+
+func (r *ClusterHelmReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	engine := (*HelmReleaseReconciler)(r)
+	ctx := engine.context()
+	_ = r.Log.WithValues("clusterhelmrelease", req.NamespacedName)
+
+	var clusterHelmRelease operatorsv1alpha1.ClusterHelmRelease
+	if err := r.Get(ctx, req.NamespacedName, &clusterHelmRelease); err != nil {
+		return ctrl.Result{}, ignoreNotFound(err)
+	}
+	return engine.reconcileRelease(ctx, &clusterHelmRelease)
+}
+
+func (r *ClusterHelmReleaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorsv1alpha1.ClusterHelmRelease{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.Get().Concurrency.ClusterHelmReleases}).
+		WithEventFilter(r.Scope.Predicate()).
+		WithEventFilter(r.Shard.Predicate()).
+		Complete(r)
+}
@@ -0,0 +1,182 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/config"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// managedDescriptionPrefix starts the description of every helm revision the
+// operator deploys. The rest of the description names the owning object, so
+// ownership survives the loss of the object's status.
+const managedDescriptionPrefix = "Managed by operators.alexeldeib.xyz "
+
+// retainedDescriptionSuffix ends the description of revisions deployed for an
+// object whose deletion policy is Retain, so that the release is not taken for
+// an orphan once the object is gone. A change of policy is a spec change, so
+// the next revision records it.
+const retainedDescriptionSuffix = " (retained on deletion)"
+
+// releaseOwner returns the kind and key of the object which owns the helm
+// release with the given history, as recorded by the newest revision the
+// operator deployed, or the empty string if the operator never deployed it.
+// Revisions deployed by other means, e.g. the rollback done by --atomic or a
+// manual helm upgrade, do not change the owner.
+func releaseOwner(revisions []helm.Revision) string {
+	owner := strings.TrimPrefix(managedDescription(revisions), managedDescriptionPrefix)
+	return strings.TrimSuffix(owner, retainedDescriptionSuffix)
+}
+
+// releaseRetained reports whether the newest revision the operator deployed
+// was deployed for an object which leaves the release installed on deletion.
+func releaseRetained(revisions []helm.Revision) bool {
+	return strings.HasSuffix(managedDescription(revisions), retainedDescriptionSuffix)
+}
+
+// managedDescription returns the description of the newest revision the
+// operator deployed, or the empty string if there is none.
+func managedDescription(revisions []helm.Revision) string {
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if strings.HasPrefix(revisions[i].Description, managedDescriptionPrefix) {
+			return revisions[i].Description
+		}
+	}
+	return ""
+}
+
+// ownerOf returns the owner recorded on helm revisions deployed for
+// helmRelease.
+func ownerOf(helmRelease releaseObject) string {
+	if _, ok := helmRelease.(*operatorsv1alpha1.ClusterHelmRelease); ok {
+		return "ClusterHelmRelease " + objectKey(helmRelease)
+	}
+	return "HelmRelease " + objectKey(helmRelease)
+}
+
+// ownerObject returns an empty object of the kind named by owner, which was
+// recorded by ownerOf, and the key of the owner.
+func ownerObject(owner string) (releaseObject, types.NamespacedName, bool) {
+	parts := strings.SplitN(owner, " ", 2)
+	if len(parts) != 2 {
+		return nil, types.NamespacedName{}, false
+	}
+	switch parts[0] {
+	case "HelmRelease":
+		key := strings.SplitN(parts[1], "/", 2)
+		if len(key) != 2 {
+			return nil, types.NamespacedName{}, false
+		}
+		return &operatorsv1alpha1.HelmRelease{}, types.NamespacedName{Namespace: key[0], Name: key[1]}, true
+	case "ClusterHelmRelease":
+		return &operatorsv1alpha1.ClusterHelmRelease{}, types.NamespacedName{Name: parts[1]}, true
+	}
+	return nil, types.NamespacedName{}, false
+}
+
+// revisionDescription returns the description of helm revisions deployed for
+// helmRelease.
+func revisionDescription(helmRelease releaseObject) string {
+	description := managedDescriptionPrefix + ownerOf(helmRelease)
+	if helmRelease.GetReleaseSpec().DeletionPolicy == operatorsv1alpha1.DeletionPolicyRetain {
+		description += retainedDescriptionSuffix
+	}
+	return description
+}
+
+// manages reports whether helmRelease may change or delete the helm release
+// with the given history.
+func (r *HelmReleaseReconciler) manages(helmRelease releaseObject, revisions []helm.Revision) bool {
+	switch releaseOwner(revisions) {
+	case ownerOf(helmRelease):
+		return true
+	case "":
+		return r.mayAdopt(helmRelease)
+	}
+	return false
+}
+
+// mayAdopt reports whether helmRelease asks to adopt a release the operator
+// did not install, and adoption is enabled.
+func (r *HelmReleaseReconciler) mayAdopt(helmRelease releaseObject) bool {
+	return helmRelease.GetAnnotations()[operatorsv1alpha1.AdoptAnnotation] == "true" &&
+		r.Config.Get().Enabled(config.Adoption)
+}
+
+// claimRelease decides whether helmRelease may manage the existing helm
+// release with the given history. A release it does not own is adopted when
+// it carries the adopt annotation, and left alone otherwise.
+func (r *HelmReleaseReconciler) claimRelease(ctx context.Context, helmRelease releaseObject, revisions []helm.Revision) (bool, error) {
+	releaseName := helmRelease.GetReleaseName()
+	status := helmRelease.GetReleaseStatus()
+
+	switch owner := releaseOwner(revisions); {
+	case owner == ownerOf(helmRelease):
+		return true, nil
+	case owner != "":
+		return false, r.refuseRelease(ctx, helmRelease, fmt.Sprintf(
+			"Helm release %s is managed by %s", releaseName, owner))
+	case helmRelease.GetAnnotations()[operatorsv1alpha1.AdoptAnnotation] != "true":
+		return false, r.refuseRelease(ctx, helmRelease, fmt.Sprintf(
+			"Helm release %s already exists and was not installed by the operator; annotate with %s=true to adopt it",
+			releaseName, operatorsv1alpha1.AdoptAnnotation))
+	case !r.mayAdopt(helmRelease):
+		return false, r.refuseRelease(ctx, helmRelease, fmt.Sprintf(
+			"Helm release %s already exists and was not installed by the operator; adoption is disabled by the manager configuration",
+			releaseName))
+	}
+
+	// Adopted, but not yet upgraded to the spec; the first successful upgrade
+	// records ownership in the release itself.
+	if status.AdoptedRevision != 0 {
+		return true, nil
+	}
+	latest := revisions[len(revisions)-1]
+	status.AdoptedRevision = latest.Revision
+	status.Revision = latest.Revision
+	status.Message = ""
+	r.Log.Info("adopting existing helm release", "release", releaseName, "revision", latest.Revision)
+	r.Recorder.Eventf(helmRelease, "Normal", "Adopted", "Adopted helm release %s at revision %d", releaseName, latest.Revision)
+	if err := r.Status().Update(ctx, helmRelease); err != nil {
+		r.Log.Error(err, "failed update status")
+		return false, err
+	}
+	return true, nil
+}
+
+// refuseRelease reports that the existing helm release of helmRelease is not
+// managed by it. The release is left untouched.
+func (r *HelmReleaseReconciler) refuseRelease(ctx context.Context, helmRelease releaseObject, message string) error {
+	status := helmRelease.GetReleaseStatus()
+	if status.Message == message {
+		return nil
+	}
+	status.Message = message
+	r.Log.Info("not managing existing helm release", "release", helmRelease.GetReleaseName(), "reason", message)
+	r.Recorder.Event(helmRelease, "Warning", "ReleaseExists", message)
+	if err := r.Status().Update(ctx, helmRelease); err != nil {
+		r.Log.Error(err, "failed update status")
+		return err
+	}
+	return nil
+}
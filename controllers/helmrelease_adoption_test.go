@@ -0,0 +1,92 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/config"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+var _ = Describe("Release ownership", func() {
+	var (
+		r           *HelmReleaseReconciler
+		helmRelease *operatorsv1alpha1.HelmRelease
+	)
+
+	BeforeEach(func() {
+		r = &HelmReleaseReconciler{}
+		helmRelease = &operatorsv1alpha1.HelmRelease{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		}
+	})
+
+	It("should not manage a release installed by hand", func() {
+		revisions := []helm.Revision{{Revision: 1, Status: helm.StatusDeployed, Description: "Install complete"}}
+		Expect(releaseOwner(revisions)).To(BeEmpty())
+		Expect(r.manages(helmRelease, revisions)).To(BeFalse())
+	})
+
+	It("should manage a release installed by hand once asked to adopt it", func() {
+		revisions := []helm.Revision{{Revision: 1, Status: helm.StatusDeployed, Description: "Install complete"}}
+		helmRelease.Annotations = map[string]string{operatorsv1alpha1.AdoptAnnotation: "true"}
+		Expect(r.manages(helmRelease, revisions)).To(BeTrue())
+	})
+
+	It("should not adopt a release when adoption is disabled", func() {
+		cfg := config.Defaults()
+		cfg.FeatureGates = map[string]bool{config.Adoption: false}
+		r.Config = config.NewStore("", cfg)
+		revisions := []helm.Revision{{Revision: 1, Status: helm.StatusDeployed, Description: "Install complete"}}
+		helmRelease.Annotations = map[string]string{operatorsv1alpha1.AdoptAnnotation: "true"}
+		Expect(r.manages(helmRelease, revisions)).To(BeFalse())
+	})
+
+	It("should keep ownership across revisions deployed by other means", func() {
+		revisions := []helm.Revision{
+			{Revision: 1, Status: helm.StatusSuperseded, Description: revisionDescription(helmRelease)},
+			{Revision: 2, Status: helm.StatusFailed, Description: "Upgrade \"nginx\" failed: timed out"},
+			{Revision: 3, Status: helm.StatusDeployed, Description: "Rollback to 1"},
+		}
+		Expect(releaseOwner(revisions)).To(Equal("HelmRelease default/nginx"))
+		Expect(r.manages(helmRelease, revisions)).To(BeTrue())
+	})
+
+	It("should record the Retain deletion policy without changing the owner", func() {
+		helmRelease.Spec.DeletionPolicy = operatorsv1alpha1.DeletionPolicyRetain
+		revisions := []helm.Revision{
+			{Revision: 1, Status: helm.StatusSuperseded, Description: "Managed by operators.alexeldeib.xyz HelmRelease default/nginx"},
+			{Revision: 2, Status: helm.StatusDeployed, Description: revisionDescription(helmRelease)},
+		}
+		Expect(releaseOwner(revisions)).To(Equal("HelmRelease default/nginx"))
+		Expect(releaseRetained(revisions)).To(BeTrue())
+		Expect(releaseRetained(revisions[:1])).To(BeFalse())
+		Expect(r.manages(helmRelease, revisions)).To(BeTrue())
+	})
+
+	It("should not let the adopt annotation take a release from its owner", func() {
+		other := &operatorsv1alpha1.ClusterHelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "nginx"}}
+		revisions := []helm.Revision{{Revision: 1, Status: helm.StatusDeployed, Description: revisionDescription(other)}}
+		helmRelease.Annotations = map[string]string{operatorsv1alpha1.AdoptAnnotation: "true"}
+		Expect(releaseOwner(revisions)).To(Equal("ClusterHelmRelease nginx"))
+		Expect(r.manages(helmRelease, revisions)).To(BeFalse())
+	})
+})
@@ -16,25 +16,26 @@ limitations under the License.
 package controllers
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"strings"
-	"sync"
-	"syscall"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 
 	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/config"
+	"github.com/alexeldeib/operators/pkg/helm"
+	"github.com/alexeldeib/operators/pkg/metrics"
 )
 
 // HelmReleaseReconciler reconciles a HelmRelease object
@@ -42,6 +43,33 @@ type HelmReleaseReconciler struct {
 	client.Client
 	Log      logr.Logger
 	Recorder record.EventRecorder
+	Helm     *helm.Client
+	// Context is cancelled when the manager receives a shutdown signal, which
+	// kills any helm process still running on behalf of this reconciler.
+	Context context.Context
+	// Config holds the feature gates and concurrency limits.
+	Config *config.Store
+	// Scope limits the releases reconciled by this manager instance.
+	Scope Scope
+	// Shard limits the releases reconciled by this replica.
+	Shard Shard
+	// Recovered, if set, is closed once RecoverPendingReleases has run.
+	// Reconciles wait for it so they cannot race the recovery.
+	Recovered <-chan struct{}
+	// Reader, if set, reads the Secrets and ConfigMaps in valuesFrom in place
+	// of Client. It should read from the API server, so that the manager
+	// does not cache every Secret in the cluster.
+	Reader client.Reader
+}
+
+// releaseObject is a HelmRelease or a ClusterHelmRelease.
+type releaseObject interface {
+	runtime.Object
+	metav1.Object
+	GetReleaseName() string
+	GetTargetNamespace() string
+	GetReleaseSpec() *operatorsv1alpha1.HelmReleaseSpec
+	GetReleaseStatus() *operatorsv1alpha1.HelmReleaseStatus
 }
 
 // +kubebuilder:rbac:groups=operators.alexeldeib.xyz,resources=helmreleases,verbs=get;list;watch;create;update;patch;delete
@@ -51,7 +79,7 @@ type HelmReleaseReconciler struct {
 // +kubebuilder:rbac:groups="",resources=events,verbs=patch;create
 
 func (r *HelmReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	_ = r.Log.WithValues("helmrelease", req.NamespacedName)
 
 	var helmRelease operatorsv1alpha1.HelmRelease
@@ -61,215 +89,348 @@ func (r *HelmReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		// on deleted requests.
 		return ctrl.Result{}, ignoreNotFound(err)
 	}
+	return r.reconcileRelease(ctx, &helmRelease)
+}
+
+// reconcileRelease drives the helm release of a HelmRelease or
+// ClusterHelmRelease towards its spec.
+func (r *HelmReleaseReconciler) reconcileRelease(ctx context.Context, helmRelease releaseObject) (ctrl.Result, error) {
+	if r.Recovered != nil {
+		select {
+		case <-r.Recovered:
+		case <-ctx.Done():
+			return ctrl.Result{}, ctx.Err()
+		}
+	}
+
+	spec, status := helmRelease.GetReleaseSpec(), helmRelease.GetReleaseStatus()
+	releaseName := helmRelease.GetReleaseName()
+	timeout := releaseTimeout(spec)
+	helmCtx, cancel := helm.TimeoutContext(ctx, timeout)
+	defer cancel()
 
 	finalizer := "helm.operators.alexeldeib.xyz"
-	if helmRelease.ObjectMeta.DeletionTimestamp.IsZero() {
-		if !containsString(helmRelease.ObjectMeta.Finalizers, finalizer) {
-			helmRelease.ObjectMeta.Finalizers = append(helmRelease.ObjectMeta.Finalizers, finalizer)
-			if err := r.Update(ctx, &helmRelease); err != nil {
+	if helmRelease.GetDeletionTimestamp().IsZero() {
+		if !containsString(helmRelease.GetFinalizers(), finalizer) {
+			helmRelease.SetFinalizers(append(helmRelease.GetFinalizers(), finalizer))
+			if err := r.Update(ctx, helmRelease); err != nil {
 				return ctrl.Result{}, err
 			}
 		}
 	} else {
-		if containsString(helmRelease.ObjectMeta.Finalizers, finalizer) {
-			historyCmd := exec.Command("/helm", "history", helmRelease.Name)
-			var histStderr bytes.Buffer
-			historyCmd.Stderr = &histStderr
-			err := historyCmd.Run()
-			histErr := histStderr.String()
-			if err != nil {
-				if strings.Trim(histErr, "\n") == strings.Trim(fmt.Sprintf("Error: release: \"%s\" not found", helmRelease.Name), "\n") {
-					helmRelease.ObjectMeta.Finalizers = removeString(helmRelease.ObjectMeta.Finalizers, finalizer)
-					if err := r.Update(ctx, &helmRelease); err != nil {
-						r.Recorder.Event(&helmRelease, "Warning", "FailedStatusUpdate", fmt.Sprintf(
-							"Could not set status for helm release %s/%s, error: %s\n",
-							helmRelease.Namespace,
-							helmRelease.Name,
-							err.Error(),
-						))
-						r.Log.Error(err, "failed update status")
-						return ctrl.Result{}, err
-					}
-				}
-				return ctrl.Result{}, errors.Wrap(err, "failed to get helm history ")
-			}
-
-			deleteCmd := exec.Command("/helm", "delete", helmRelease.Name, "--purge")
-
-			var outbuf, errbuf bytes.Buffer
-			stdoutIn, err := deleteCmd.StdoutPipe()
-			if err != nil {
-				return ctrl.Result{}, errors.Wrap(err, "failed to attach stdout pipe for helm")
-			}
-
-			stderrIn, err := deleteCmd.StderrPipe()
-			if err != nil {
-				return ctrl.Result{}, errors.Wrap(err, "failed to attach stderr pipe for helm")
-			}
-
-			var errStdout, errStderr error
-			stdout := io.MultiWriter(os.Stdout, &outbuf)
-			stderr := io.MultiWriter(os.Stderr, &errbuf)
-
-			r.Log.Info("Executing helm deletion")
-
-			if err = deleteCmd.Start(); err != nil {
-				return ctrl.Result{}, errors.Wrap(err, "failed to start helm")
-			}
-
-			// Wait with progress.
-			var wg sync.WaitGroup
-			wg.Add(1)
-
-			go func() {
-				_, errStdout = io.Copy(stdout, stdoutIn)
-				wg.Done()
-			}()
-
-			_, errStderr = io.Copy(stderr, stderrIn)
-			wg.Wait()
-
-			err = deleteCmd.Wait()
-			if errStderr != nil {
-				r.Log.Error(errStderr, "Unable to log stderr from helm", "errStderr")
-			}
-			if errStdout != nil {
-				r.Log.Error(errStdout, "Unable to log stdout from helm", "errStdout")
-			}
-			if err != nil {
-				// Ok is true if the error is non-nil and indicates the command ran to completion with non-zero exit code.
-				if exiterr, ok := err.(*exec.ExitError); ok {
-					if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-						return ctrl.Result{}, errors.Wrapf(err, "helm exited with code %d,\n stdout: %s,\n stderr: %s\n", status.ExitStatus(), string(outbuf.Bytes()), string(errbuf.Bytes()))
-					}
-				} else {
-					// Err is non-nil but the error came from waiting/executing rather than from the running command exiting with error.
-					return ctrl.Result{}, errors.Wrap(err, "failed to wait on helm")
-				}
+		if containsString(helmRelease.GetFinalizers(), finalizer) {
+			if err := r.deleteRelease(helmCtx, helmRelease, releaseName); err != nil {
+				return ctrl.Result{}, err
 			}
-			helmRelease.ObjectMeta.Finalizers = removeString(helmRelease.ObjectMeta.Finalizers, finalizer)
-			if err := r.Update(ctx, &helmRelease); err != nil {
-				r.Recorder.Event(&helmRelease, "Warning", "FailedStatusUpdate", fmt.Sprintf(
-					"Could not set status for helm release %s/%s, error: %s\n",
-					helmRelease.Namespace,
-					helmRelease.Name,
+			helmRelease.SetFinalizers(removeString(helmRelease.GetFinalizers(), finalizer))
+			if err := r.Update(ctx, helmRelease); err != nil {
+				r.Recorder.Event(helmRelease, "Warning", "FailedStatusUpdate", fmt.Sprintf(
+					"Could not set status for helm release %s, error: %s\n",
+					objectKey(helmRelease),
 					err.Error(),
 				))
 				r.Log.Error(err, "failed update status")
 				return ctrl.Result{}, err
 			}
 			r.Log.Info("successfully deleted helm release")
-			return ctrl.Result{}, nil
 		}
+		return ctrl.Result{}, nil
 	}
 
-	// TODO(ace): set status based on /helm status -o json output + code
-	// TODO(ace): diff actual and desired; don't update if not necessary.
-	historyCmd := exec.Command("/helm", "history", helmRelease.Name)
-	var histStderr bytes.Buffer
-	historyCmd.Stderr = &histStderr
-	err := historyCmd.Run()
-	if err == nil {
-		r.Log.Info("Found existing release, will not reconcile (TODO)")
+	// A new spec gets a fresh set of attempts; otherwise honour the backoff
+	// recorded by the last failure.
+	if status.ObservedGeneration != helmRelease.GetGeneration() {
+		resetFailures(status)
+	} else if operatorsv1alpha1.IsConditionTrue(status.Conditions, operatorsv1alpha1.ConditionStalled) {
+		r.Log.Info("release is stalled, waiting for a spec change", "failures", status.Failures)
 		return ctrl.Result{}, nil
+	} else if next := status.NextRetryTime; next != nil {
+		if wait := time.Until(next.Time); wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
 	}
 
-	var createCmd *exec.Cmd
-	args := []string{"upgrade", "--install", "--wait", "--force", "--atomic", helmRelease.Name, helmRelease.Spec.Chart, "--namespace", helmRelease.Namespace}
+	// Objects stored while the webhooks were disabled may lack a target
+	// namespace; helm would silently fall back to its own default.
+	if helmRelease.GetTargetNamespace() == "" {
+		return r.recordFailure(ctx, helmRelease, "InvalidSpec", errors.New("spec.targetNamespace is required"))
+	}
 
-	// This is more or less how config maps work, they model arbitrary data as string and write to a file.
-	// TODO(ace): probably create a struct wih 1:1 mapping to nginx values yaml.
-	// Their config is quite large, so unless validation becomes a problem will probably stick to this.
-	if helmRelease.Spec.Values != "" {
-		tmpFile, err := ioutil.TempFile(os.TempDir(), "")
-		if err != nil {
-			r.Log.Error(err, "Cannot create temporary file for values.yml")
-			return ctrl.Result{}, err
-		}
+	// Values are resolved before deciding whether to upgrade, as edits to
+	// their sources leave the spec unchanged.
+	values, err := r.resolveValues(ctx, helmRelease)
+	if err != nil {
+		return r.recordFailure(ctx, helmRelease, "FailedValues", err)
+	}
 
-		// Remember to clean up the file afterwards
-		defer os.Remove(tmpFile.Name())
-		if _, err := tmpFile.Write([]byte(helmRelease.Spec.Values)); err != nil {
-			r.Log.Error(err, "Failed to write tmpfile with values.yaml")
+	revisions, err := r.Helm.History(helmCtx, releaseName)
+	if err != nil && !helm.IsReleaseNotFound(err, releaseName) {
+		return ctrl.Result{}, errors.Wrap(err, "failed to get helm history ")
+	}
+	if len(revisions) > 0 {
+		managed, err := r.claimRelease(ctx, helmRelease, revisions)
+		if err != nil || !managed {
 			return ctrl.Result{}, err
 		}
-		args = append(args, "-f", tmpFile.Name())
-	}
-
-	if helmRelease.Spec.Overrides != nil {
-		for _, override := range helmRelease.Spec.Overrides {
-			args = append(args, "--set", override)
+		// TODO(ace): diff actual and desired rather than trusting the
+		// generation, so that changes made behind our back are reverted.
+		// A failed upgrade is rolled back by --atomic and also leaves the
+		// latest revision deployed, so only a generation which was applied
+		// successfully counts.
+		latest := revisions[len(revisions)-1]
+		if releaseOwner(revisions) == ownerOf(helmRelease) &&
+			status.LastAppliedGeneration == helmRelease.GetGeneration() &&
+			status.LastAppliedValuesHash == values.hash() &&
+			latest.Status == helm.StatusDeployed {
+			return ctrl.Result{}, r.updateStatus(ctx, helmRelease, revisions, values.hash())
 		}
 	}
 
-	createCmd = exec.Command("/helm", args...)
-	var outbuf, errbuf bytes.Buffer
-	stdoutIn, err := createCmd.StdoutPipe()
-	if err != nil {
-		return ctrl.Result{}, errors.Wrap(err, "failed to attach stdout pipe for hem")
+	opts := helm.UpgradeOptions{
+		Name:        releaseName,
+		Chart:       spec.Chart,
+		Version:     spec.Version,
+		Namespace:   helmRelease.GetTargetNamespace(),
+		Overrides:   values.overrides,
+		Timeout:     timeout,
+		Description: revisionDescription(helmRelease),
 	}
 
-	stderrIn, err := createCmd.StderrPipe()
+	// This is more or less how config maps work, they model arbitrary data as string and hand it to helm as a file.
+	// Values often carry credentials, so they are passed to helm on stdin rather than written to disk.
+	opts.Values, err = helm.MergeValues(values.documents...)
 	if err != nil {
-		return ctrl.Result{}, errors.Wrap(err, "failed to attach stderr pipe for hem")
+		metrics.ValuesFetchFailures.WithLabelValues(helmRelease.GetNamespace(), helmRelease.GetName(), "inline").Inc()
+		return r.recordFailure(ctx, helmRelease, "FailedValues", err)
 	}
 
-	var errStdout, errStderr error
-	stdout := io.MultiWriter(os.Stdout, &outbuf)
-	stderr := io.MultiWriter(os.Stderr, &errbuf)
+	if status.ProvisioningState != operatorsv1alpha1.ProvisioningStateDeploying {
+		status.ProvisioningState = operatorsv1alpha1.ProvisioningStateDeploying
+		status.Message = ""
+		if err := r.Status().Update(ctx, helmRelease); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
 	r.Log.Info("Executing helm")
-
-	if err = createCmd.Start(); err != nil {
-		return ctrl.Result{}, errors.Wrap(err, "failed to start helm")
+	if err := r.Helm.WithRedactor(values.redactor).UpgradeInstall(helmCtx, opts); err != nil {
+		// Helm errors can echo values back; nothing past this point may see
+		// the unredacted error.
+		err = values.redactor.Error(errors.Wrap(err, "failed to install helm release"))
+		if ctx.Err() != nil {
+			// Interrupted by shutdown; this is not the release's fault.
+			return ctrl.Result{}, err
+		}
+		return r.recordFailure(ctx, helmRelease, "FailedInstall", err)
 	}
 
-	// Wait with progress.
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		_, errStdout = io.Copy(stdout, stdoutIn)
-		wg.Done()
-	}()
-
-	_, errStderr = io.Copy(stderr, stderrIn)
-	wg.Wait()
+	revisions, err = r.Helm.History(helmCtx, releaseName)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to get helm history ")
+	}
+	return ctrl.Result{}, r.updateStatus(ctx, helmRelease, revisions, values.hash())
+}
 
-	err = createCmd.Wait()
-	if errStderr != nil {
-		r.Log.Error(errStderr, "Unable to log stderr from helm", "errStderr")
+// updateStatus records the state of the latest helm revision on helmRelease,
+// deployed with the values sources identified by valuesHash.
+func (r *HelmReleaseReconciler) updateStatus(ctx context.Context, helmRelease releaseObject, revisions []helm.Revision, valuesHash string) error {
+	if len(revisions) == 0 {
+		return nil
 	}
-	if errStdout != nil {
-		r.Log.Error(errStdout, "Unable to log stdout from helm", "errStdout")
+	latest := revisions[len(revisions)-1]
+	status := helmRelease.GetReleaseStatus().DeepCopy()
+	status.ProvisioningState = operatorsv1alpha1.ProvisioningStateDeploying
+	switch latest.Status {
+	case helm.StatusDeployed:
+		status.ProvisioningState = operatorsv1alpha1.ProvisioningStateSucceeded
+		status.Message = ""
+		status.ObservedGeneration = helmRelease.GetGeneration()
+		status.LastAppliedGeneration = helmRelease.GetGeneration()
+		status.LastAppliedValuesHash = valuesHash
+		resetFailures(status)
+	case helm.StatusFailed:
+		status.ProvisioningState = operatorsv1alpha1.ProvisioningStateFailed
 	}
-	if err != nil {
-		// Ok is true if the error is non-nil and indicates the command ran to completion with non-zero exit code.
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				return ctrl.Result{}, errors.Wrapf(err, "helm exited with code %d,\n stdout: %s,\n stderr: %s\n", status.ExitStatus(), string(outbuf.Bytes()), string(errbuf.Bytes()))
-			}
-		} else {
-			// Err is non-nil but the error came from waiting/executing rather than from the running command exiting with error.
-			return ctrl.Result{}, errors.Wrap(err, "failed to wait on helm")
-		}
+	status.Revision = latest.Revision
+	if apiequality.Semantic.DeepEqual(helmRelease.GetReleaseStatus(), status) {
+		return nil
+	}
+	*helmRelease.GetReleaseStatus() = *status
+	if err := r.Status().Update(ctx, helmRelease); err != nil {
+		r.Log.Error(err, "failed update status")
+		return err
+	}
+	return nil
+}
+
+// recordFailure counts a failed attempt in helmRelease's status and schedules
+// the next one with exponential backoff, or marks the release Stalled once
+// its retries are exhausted. err must already be redacted.
+func (r *HelmReleaseReconciler) recordFailure(ctx context.Context, helmRelease releaseObject, reason string, err error) (ctrl.Result, error) {
+	policy := retryPolicyFor(helmRelease.GetReleaseSpec())
+	now := metav1.Now()
+	status := helmRelease.GetReleaseStatus()
+	status.Failures++
+	status.LastFailureTime = &now
+	status.LastFailureReason = reason
+	status.Message = err.Error()
+	status.ProvisioningState = operatorsv1alpha1.ProvisioningStateFailed
+	status.ObservedGeneration = helmRelease.GetGeneration()
+
+	r.Recorder.Event(helmRelease, "Warning", reason, err.Error())
+	r.Log.Error(err, "helm release failed", "helmrelease", objectKey(helmRelease), "failures", status.Failures)
+
+	var result ctrl.Result
+	if policy.maxAttempts > 0 && status.Failures >= policy.maxAttempts {
+		status.NextRetryTime = nil
+		operatorsv1alpha1.SetCondition(&status.Conditions, operatorsv1alpha1.Condition{
+			Type:    operatorsv1alpha1.ConditionStalled,
+			Status:  corev1.ConditionTrue,
+			Reason:  "RetriesExhausted",
+			Message: fmt.Sprintf("%d consecutive failures, waiting for a spec change", status.Failures),
+		})
+		r.Recorder.Event(helmRelease, "Warning", "Stalled", "Retries exhausted, waiting for a spec change")
+	} else {
+		backoff := policy.backoff(status.Failures)
+		next := metav1.NewTime(now.Add(backoff))
+		status.NextRetryTime = &next
+		result.RequeueAfter = backoff
 	}
 
-	return ctrl.Result{}, nil
+	if updateErr := r.Status().Update(ctx, helmRelease); updateErr != nil {
+		r.Log.Error(updateErr, "failed update status")
+		return ctrl.Result{}, updateErr
+	}
+	return result, nil
 }
 
 func (r *HelmReleaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&operatorsv1alpha1.HelmRelease{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.Get().Concurrency.HelmReleases}).
+		WithEventFilter(r.Scope.Predicate()).
+		WithEventFilter(r.Shard.Predicate()).
 		Complete(r)
 }
 
+// deleteRelease removes the helm release of helmRelease as its deletion
+// policy says. A release which is already gone is not an error, and one which
+// helmRelease does not manage is left alone.
+func (r *HelmReleaseReconciler) deleteRelease(ctx context.Context, helmRelease releaseObject, releaseName string) error {
+	if helmRelease.GetReleaseSpec().DeletionPolicy == operatorsv1alpha1.DeletionPolicyRetain {
+		// The policy reaches the release with the next revision; a release
+		// last deployed under Purge still looks like an orphan once we are gone.
+		revisions, err := r.Helm.History(ctx, releaseName)
+		if err == nil && releaseOwner(revisions) == ownerOf(helmRelease) && !releaseRetained(revisions) {
+			r.Recorder.Event(helmRelease, "Warning", "RetainNotRecorded", "Helm release was last deployed under the Purge deletion policy and may be purged as an orphan")
+		}
+		r.Log.Info("retaining helm release", "release", releaseName)
+		r.Recorder.Event(helmRelease, "Normal", "Retained", "Leaving helm release installed as requested by the deletion policy")
+		return nil
+	}
+
+	revisions, err := r.Helm.History(ctx, releaseName)
+	if err != nil {
+		if helm.IsReleaseNotFound(err, releaseName) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to get helm history ")
+	}
+	if !r.manages(helmRelease, revisions) {
+		r.Log.Info("leaving helm release which is not managed by this object", "release", releaseName)
+		r.Recorder.Event(helmRelease, "Normal", "Retained", "Leaving helm release installed as it is not managed by this object")
+		return nil
+	}
+
+	r.Log.Info("Executing helm deletion")
+	if err := r.Helm.Delete(ctx, releaseName); err != nil {
+		return errors.Wrap(err, "failed to delete helm release")
+	}
+	return nil
+}
+
 //
 //
 // Helpers below this line
 //
 //
 
+// context returns the context helm operations run under.
+func (r *HelmReleaseReconciler) context() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+	return r.Context
+}
+
+// objectKey returns namespace/name for namespaced objects and name for
+// cluster-scoped ones.
+func objectKey(obj metav1.Object) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// releaseTimeout returns the per-operation timeout for a release.
+func releaseTimeout(spec *operatorsv1alpha1.HelmReleaseSpec) time.Duration {
+	if spec.Timeout != nil && spec.Timeout.Duration > 0 {
+		return spec.Timeout.Duration
+	}
+	return operatorsv1alpha1.DefaultTimeout
+}
+
+type retryPolicy struct {
+	maxAttempts    int32
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// retryPolicyFor returns the retry policy of a release with defaults applied.
+func retryPolicyFor(releaseSpec *operatorsv1alpha1.HelmReleaseSpec) retryPolicy {
+	policy := retryPolicy{
+		maxAttempts:    operatorsv1alpha1.DefaultMaxAttempts,
+		initialBackoff: operatorsv1alpha1.DefaultInitialBackoff,
+		maxBackoff:     operatorsv1alpha1.DefaultMaxBackoff,
+	}
+	spec := releaseSpec.Retry
+	if spec == nil {
+		return policy
+	}
+	if spec.MaxAttempts != nil {
+		policy.maxAttempts = *spec.MaxAttempts
+	}
+	if spec.InitialBackoff != nil && spec.InitialBackoff.Duration > 0 {
+		policy.initialBackoff = spec.InitialBackoff.Duration
+	}
+	if spec.MaxBackoff != nil && spec.MaxBackoff.Duration > 0 {
+		policy.maxBackoff = spec.MaxBackoff.Duration
+	}
+	return policy
+}
+
+// backoff returns the delay before the attempt following the given number of
+// consecutive failures.
+func (p retryPolicy) backoff(failures int32) time.Duration {
+	delay := p.initialBackoff
+	for i := int32(1); i < failures && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	return delay
+}
+
+// resetFailures clears failure tracking, e.g. after a success or a spec change.
+func resetFailures(status *operatorsv1alpha1.HelmReleaseStatus) {
+	status.Failures = 0
+	status.LastFailureTime = nil
+	status.LastFailureReason = ""
+	status.NextRetryTime = nil
+	operatorsv1alpha1.RemoveCondition(&status.Conditions, operatorsv1alpha1.ConditionStalled)
+}
+
 func ignoreNotFound(err error) error {
 	if apierrs.IsNotFound(err) {
 		return nil
@@ -0,0 +1,274 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// atomicHelm stands in for helm with a release deployed by the HelmRelease
+// default/nginx. The first upgrade fails and is rolled back as --atomic
+// would, leaving a deployed revision behind; later upgrades succeed. Each
+// upgrade is appended to upgrades.
+const atomicHelm = `dir="$(dirname "$0")"
+owned='"description":"Managed by operators.alexeldeib.xyz HelmRelease default/nginx"'
+case "$1" in
+history)
+	if [ ! -f "$dir/state" ]; then
+		echo "[{\"revision\":1,\"status\":\"DEPLOYED\",$owned}]"
+	elif [ "$(cat "$dir/state")" = rolledback ]; then
+		echo "[{\"revision\":1,\"status\":\"SUPERSEDED\",$owned},{\"revision\":2,\"status\":\"FAILED\",$owned},{\"revision\":3,\"status\":\"DEPLOYED\",\"description\":\"Rollback to 1\"}]"
+	else
+		echo "[{\"revision\":1,\"status\":\"SUPERSEDED\",$owned},{\"revision\":2,\"status\":\"FAILED\",$owned},{\"revision\":3,\"status\":\"SUPERSEDED\",\"description\":\"Rollback to 1\"},{\"revision\":4,\"status\":\"DEPLOYED\",$owned}]"
+	fi ;;
+upgrade)
+	echo upgrade >> "$dir/upgrades"
+	if [ ! -f "$dir/state" ]; then
+		echo rolledback > "$dir/state"
+		echo "Error: UPGRADE FAILED: timed out waiting for the condition" >&2
+		exit 1
+	fi
+	echo applied > "$dir/state" ;;
+esac
+`
+
+var _ = Describe("HelmRelease retries", func() {
+	It("should back off exponentially up to the maximum", func() {
+		policy := retryPolicyFor(&operatorsv1alpha1.HelmReleaseSpec{})
+		for _, tc := range []struct {
+			failures int32
+			want     time.Duration
+		}{
+			{failures: 1, want: 10 * time.Second},
+			{failures: 2, want: 20 * time.Second},
+			{failures: 4, want: 80 * time.Second},
+			{failures: 6, want: 320 * time.Second},
+			{failures: 7, want: 10 * time.Minute},
+			{failures: 100, want: 10 * time.Minute},
+		} {
+			Expect(policy.backoff(tc.failures)).To(Equal(tc.want), "after %d failures", tc.failures)
+		}
+	})
+
+	It("should apply the release's retry policy over the defaults", func() {
+		zero := int32(0)
+		for _, tc := range []struct {
+			name string
+			spec *operatorsv1alpha1.RetryPolicy
+			want retryPolicy
+		}{
+			{
+				name: "unset",
+				want: retryPolicy{maxAttempts: 5, initialBackoff: 10 * time.Second, maxBackoff: 10 * time.Minute},
+			},
+			{
+				name: "retry forever",
+				spec: &operatorsv1alpha1.RetryPolicy{MaxAttempts: &zero},
+				want: retryPolicy{maxAttempts: 0, initialBackoff: 10 * time.Second, maxBackoff: 10 * time.Minute},
+			},
+			{
+				name: "custom backoff",
+				spec: &operatorsv1alpha1.RetryPolicy{
+					InitialBackoff: &metav1.Duration{Duration: time.Second},
+					MaxBackoff:     &metav1.Duration{Duration: time.Minute},
+				},
+				want: retryPolicy{maxAttempts: 5, initialBackoff: time.Second, maxBackoff: time.Minute},
+			},
+			{
+				name: "zero durations",
+				spec: &operatorsv1alpha1.RetryPolicy{
+					InitialBackoff: &metav1.Duration{},
+					MaxBackoff:     &metav1.Duration{},
+				},
+				want: retryPolicy{maxAttempts: 5, initialBackoff: 10 * time.Second, maxBackoff: 10 * time.Minute},
+			},
+		} {
+			spec := &operatorsv1alpha1.HelmReleaseSpec{Retry: tc.spec}
+			Expect(retryPolicyFor(spec)).To(Equal(tc.want), tc.name)
+		}
+	})
+
+	Describe("recordFailure", func() {
+		var (
+			r           *HelmReleaseReconciler
+			helmRelease *operatorsv1alpha1.HelmRelease
+		)
+
+		BeforeEach(func() {
+			maxAttempts := int32(3)
+			helmRelease = &operatorsv1alpha1.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Generation: 2},
+				Spec: operatorsv1alpha1.HelmReleaseSpec{
+					Retry: &operatorsv1alpha1.RetryPolicy{MaxAttempts: &maxAttempts},
+				},
+			}
+			stored := helmRelease.DeepCopy()
+			s := runtime.NewScheme()
+			Expect(operatorsv1alpha1.AddToScheme(s)).To(Succeed())
+			r = &HelmReleaseReconciler{
+				Client:   fake.NewFakeClientWithScheme(s, stored),
+				Recorder: record.NewFakeRecorder(10),
+				Log:      logf.Log,
+			}
+			key := types.NamespacedName{Name: "nginx", Namespace: "default"}
+			Expect(r.Get(context.Background(), key, helmRelease)).To(Succeed())
+		})
+
+		It("should count failures until the release stalls", func() {
+			for _, tc := range []struct {
+				failures  int32
+				requeue   time.Duration
+				stalled   bool
+				nextRetry bool
+			}{
+				{failures: 1, requeue: 10 * time.Second, nextRetry: true},
+				{failures: 2, requeue: 20 * time.Second, nextRetry: true},
+				{failures: 3, stalled: true},
+			} {
+				result, err := r.recordFailure(context.Background(), helmRelease, "FailedInstall", errors.New("boom"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.RequeueAfter).To(Equal(tc.requeue), "after %d failures", tc.failures)
+
+				status := helmRelease.Status
+				Expect(status.Failures).To(Equal(tc.failures))
+				Expect(status.ProvisioningState).To(Equal(operatorsv1alpha1.ProvisioningStateFailed))
+				Expect(status.LastFailureReason).To(Equal("FailedInstall"))
+				Expect(status.Message).To(Equal("boom"))
+				Expect(status.ObservedGeneration).To(BeEquivalentTo(2))
+				Expect(status.NextRetryTime != nil).To(Equal(tc.nextRetry))
+				Expect(operatorsv1alpha1.IsConditionTrue(status.Conditions, operatorsv1alpha1.ConditionStalled)).To(Equal(tc.stalled))
+			}
+
+			resetFailures(&helmRelease.Status)
+			Expect(helmRelease.Status.Failures).To(BeZero())
+			Expect(helmRelease.Status.NextRetryTime).To(BeNil())
+			Expect(operatorsv1alpha1.IsConditionTrue(helmRelease.Status.Conditions, operatorsv1alpha1.ConditionStalled)).To(BeFalse())
+		})
+	})
+
+	Describe("a failed upgrade", func() {
+		var (
+			dir string
+			r   *HelmReleaseReconciler
+			key = types.NamespacedName{Name: "nginx", Namespace: "default"}
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "retry-test")
+			Expect(err).NotTo(HaveOccurred())
+			path := filepath.Join(dir, "helm")
+			Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+atomicHelm), 0700)).To(Succeed())
+
+			// Generation 1 was deployed; the spec has since changed.
+			helmRelease := &operatorsv1alpha1.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "nginx",
+					Namespace:  "default",
+					Generation: 2,
+					Finalizers: []string{"helm.operators.alexeldeib.xyz"},
+				},
+				Spec: operatorsv1alpha1.HelmReleaseSpec{
+					Chart:           "stable/nginx-ingress",
+					TargetNamespace: "default",
+				},
+				Status: operatorsv1alpha1.HelmReleaseStatus{
+					ProvisioningState:     operatorsv1alpha1.ProvisioningStateSucceeded,
+					Revision:              1,
+					ObservedGeneration:    1,
+					LastAppliedGeneration: 1,
+				},
+			}
+			s := runtime.NewScheme()
+			Expect(operatorsv1alpha1.AddToScheme(s)).To(Succeed())
+			r = &HelmReleaseReconciler{
+				Client:   fake.NewFakeClientWithScheme(s, helmRelease),
+				Helm:     helm.New(path, logf.Log),
+				Recorder: record.NewFakeRecorder(10),
+				Log:      logf.Log,
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		get := func() *operatorsv1alpha1.HelmRelease {
+			var helmRelease operatorsv1alpha1.HelmRelease
+			Expect(r.Get(context.Background(), key, &helmRelease)).To(Succeed())
+			return &helmRelease
+		}
+
+		upgrades := func() int {
+			data, err := ioutil.ReadFile(filepath.Join(dir, "upgrades"))
+			Expect(err).NotTo(HaveOccurred())
+			return strings.Count(string(data), "upgrade")
+		}
+
+		It("should be retried although helm rolled it back", func() {
+			result, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+			Expect(upgrades()).To(Equal(1))
+
+			helmRelease := get()
+			Expect(helmRelease.Status.Failures).To(BeEquivalentTo(1))
+			Expect(helmRelease.Status.ObservedGeneration).To(BeEquivalentTo(2))
+			Expect(helmRelease.Status.LastAppliedGeneration).To(BeEquivalentTo(1))
+
+			// Let the backoff expire. The rolled back release is deployed,
+			// but the failed generation was never applied.
+			past := metav1.NewTime(time.Now().Add(-time.Second))
+			helmRelease.Status.NextRetryTime = &past
+			Expect(r.Status().Update(context.Background(), helmRelease)).To(Succeed())
+
+			_, err = r.Reconcile(ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upgrades()).To(Equal(2))
+
+			helmRelease = get()
+			Expect(helmRelease.Status.ProvisioningState).To(Equal(operatorsv1alpha1.ProvisioningStateSucceeded))
+			Expect(helmRelease.Status.Revision).To(BeEquivalentTo(4))
+			Expect(helmRelease.Status.Failures).To(BeZero())
+			Expect(helmRelease.Status.LastAppliedGeneration).To(BeEquivalentTo(2))
+
+			// Applied; nothing left to do.
+			_, err = r.Reconcile(ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upgrades()).To(Equal(2))
+		})
+	})
+})
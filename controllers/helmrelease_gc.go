@@ -0,0 +1,187 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/alexeldeib/operators/pkg/helm"
+	"github.com/alexeldeib/operators/pkg/metrics"
+)
+
+// OrphanCollector finds helm releases deployed by the operator whose
+// HelmRelease or ClusterHelmRelease no longer exists, e.g. because its
+// finalizer was removed by hand or its CRD was deleted. Orphans are reported
+// as events on their namespace and by the operators_helm_orphaned_release
+// metric, and purged once they have been orphaned for PurgeAfter.
+type OrphanCollector struct {
+	// Reader should not be cached: the cache can lag behind, and cannot
+	// answer at all once a CRD is gone.
+	Reader   client.Reader
+	Helm     *helm.Client
+	Recorder record.EventRecorder
+	Log      logr.Logger
+	// Interval is the time between two sweeps.
+	Interval time.Duration
+	// PurgeAfter is how long a release must stay orphaned before it is
+	// purged. Zero only reports orphans.
+	PurgeAfter time.Duration
+	// Context is cancelled when the manager receives a shutdown signal.
+	Context context.Context
+
+	// orphanedSince records when each orphan was first seen. It lives in
+	// memory, so restarting the manager restarts every grace period.
+	orphanedSince map[string]time.Time
+}
+
+// Start implements manager.Runnable.
+func (c *OrphanCollector) Start(stop <-chan struct{}) error {
+	ctx := c.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sweep(ctx); err != nil {
+			c.Log.Error(err, "failed to collect orphaned helm releases")
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep checks every helm release for an owner once, reporting and purging
+// orphans.
+func (c *OrphanCollector) Sweep(ctx context.Context) error {
+	releases, err := c.Helm.List(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list helm releases")
+	}
+	if c.orphanedSince == nil {
+		c.orphanedSince = map[string]time.Time{}
+	}
+
+	now := time.Now()
+	orphans := map[string]bool{}
+	metrics.OrphanedReleases.Reset()
+	for _, release := range releases {
+		log := c.Log.WithValues("release", release.Name)
+		// helm list --all includes releases deleted without --purge, which
+		// only keep their history.
+		if release.Status == helm.StatusDeleted {
+			continue
+		}
+
+		owner, orphaned, err := c.orphanOwner(ctx, release)
+		if err != nil {
+			// Keep the grace period running across a failed check.
+			log.Error(err, "failed to find the owner of helm release")
+			_, orphans[release.Name] = c.orphanedSince[release.Name]
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+		orphans[release.Name] = true
+
+		since, ok := c.orphanedSince[release.Name]
+		if !ok {
+			since = now
+			c.orphanedSince[release.Name] = since
+			log.Info("found orphaned helm release", "owner", owner)
+			c.Recorder.Eventf(namespaceObject(release.Namespace), "Warning", "OrphanedRelease",
+				"Helm release %s was deployed for %s, which no longer exists", release.Name, owner)
+		}
+
+		if c.PurgeAfter > 0 && now.Sub(since) >= c.PurgeAfter {
+			log.Info("purging orphaned helm release", "owner", owner, "orphanedSince", since)
+			if err := c.Helm.Delete(ctx, release.Name); err != nil {
+				log.Error(err, "failed to purge orphaned helm release")
+			} else {
+				metrics.OrphanedReleasesPurged.Inc()
+				c.Recorder.Eventf(namespaceObject(release.Namespace), "Normal", "PurgedOrphan",
+					"Purged helm release %s, orphaned since %s", release.Name, since.Format(time.RFC3339))
+				delete(orphans, release.Name)
+				continue
+			}
+		}
+		metrics.OrphanedReleases.WithLabelValues(release.Name, release.Namespace, owner).Set(1)
+	}
+
+	for name := range c.orphanedSince {
+		if !orphans[name] {
+			delete(c.orphanedSince, name)
+		}
+	}
+	return nil
+}
+
+// orphanOwner returns the recorded owner of release, and whether that owner
+// no longer manages it. Releases the operator never deployed have no owner
+// and are never orphans, nor are releases deployed with the Retain deletion
+// policy.
+func (c *OrphanCollector) orphanOwner(ctx context.Context, release helm.Release) (string, bool, error) {
+	revisions, err := c.Helm.History(ctx, release.Name)
+	if err != nil {
+		if helm.IsReleaseNotFound(err, release.Name) {
+			return "", false, nil
+		}
+		return "", false, errors.Wrap(err, "failed to get helm history")
+	}
+	owner := releaseOwner(revisions)
+	if owner == "" {
+		return "", false, nil
+	}
+	// Retained releases outlive their owner on purpose.
+	if releaseRetained(revisions) {
+		return owner, false, nil
+	}
+
+	obj, key, ok := ownerObject(owner)
+	if !ok {
+		return owner, false, errors.Errorf("unrecognised owner %q", owner)
+	}
+	if err := c.Reader.Get(ctx, key, obj); err != nil {
+		if ignoreNotFound(err) == nil || meta.IsNoMatchError(err) {
+			return owner, true, nil
+		}
+		return owner, false, errors.Wrapf(err, "failed to get %s", owner)
+	}
+	// The owner may have been deleted and recreated for another release.
+	return owner, obj.GetReleaseName() != release.Name, nil
+}
+
+// namespaceObject returns a reference to namespace for recording events about
+// objects which have no API object of their own.
+func namespaceObject(namespace string) *corev1.Namespace {
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+}
@@ -0,0 +1,114 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// orphanHelm stands in for helm with five releases: one owned by the
+// HelmRelease default/owned, one owned by the deleted HelmRelease default/gone,
+// one retained on deletion of the HelmRelease default/kept, one deleted
+// without --purge and one installed by hand. Purged releases are appended to
+// deleted.
+const orphanHelm = `case "$1" in
+list) echo '{"Releases":[{"Name":"owned","Namespace":"default"},{"Name":"orphan","Namespace":"web"},{"Name":"retained","Namespace":"default"},{"Name":"removed","Namespace":"default","Status":"DELETED"},{"Name":"manual","Namespace":"default"}]}' ;;
+history)
+	case "$2" in
+	owned) echo '[{"revision":1,"status":"DEPLOYED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/owned"}]' ;;
+	orphan) echo '[{"revision":1,"status":"DEPLOYED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/gone"}]' ;;
+	retained) echo '[{"revision":1,"status":"DEPLOYED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/kept (retained on deletion)"}]' ;;
+	removed) echo '[{"revision":1,"status":"DELETED","description":"Deletion complete"},{"revision":1,"status":"SUPERSEDED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/removed"}]' ;;
+	*) echo '[{"revision":1,"status":"DEPLOYED","description":"Install complete"}]' ;;
+	esac ;;
+delete) echo "$2" >> "$(dirname "$0")/deleted" ;;
+esac
+`
+
+var _ = Describe("OrphanCollector", func() {
+	var (
+		dir       string
+		recorder  *record.FakeRecorder
+		collector *OrphanCollector
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "orphan-test")
+		Expect(err).NotTo(HaveOccurred())
+		path := filepath.Join(dir, "helm")
+		Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+orphanHelm), 0700)).To(Succeed())
+
+		s := runtime.NewScheme()
+		Expect(operatorsv1alpha1.AddToScheme(s)).To(Succeed())
+		owned := &operatorsv1alpha1.HelmRelease{
+			ObjectMeta: metav1.ObjectMeta{Name: "owned", Namespace: "default"},
+		}
+
+		recorder = record.NewFakeRecorder(10)
+		collector = &OrphanCollector{
+			Reader:   fake.NewFakeClientWithScheme(s, owned),
+			Helm:     helm.New(path, logf.Log),
+			Recorder: recorder,
+			Log:      logf.Log,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should report only releases whose owner is gone", func() {
+		Expect(collector.Sweep(context.Background())).To(Succeed())
+		Expect(collector.orphanedSince).To(HaveLen(1))
+		Expect(collector.orphanedSince).To(HaveKey("orphan"))
+		Expect(recorder.Events).To(Receive(ContainSubstring("OrphanedRelease")))
+
+		// Reported once, not on every sweep.
+		Expect(collector.Sweep(context.Background())).To(Succeed())
+		Expect(recorder.Events).NotTo(Receive())
+		Expect(filepath.Join(dir, "deleted")).NotTo(BeAnExistingFile())
+	})
+
+	It("should purge orphans after the grace period", func() {
+		collector.PurgeAfter = time.Millisecond
+		Expect(collector.Sweep(context.Background())).To(Succeed())
+		Expect(filepath.Join(dir, "deleted")).NotTo(BeAnExistingFile())
+
+		time.Sleep(10 * time.Millisecond)
+		Expect(collector.Sweep(context.Background())).To(Succeed())
+		deleted, err := ioutil.ReadFile(filepath.Join(dir, "deleted"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(deleted)).To(Equal("orphan\n"))
+		Expect(collector.orphanedSince).To(BeEmpty())
+	})
+})
@@ -0,0 +1,144 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// RecoverPendingReleases resolves releases left in a pending state by a
+// manager that was killed mid-operation. Only releases backed by a
+// HelmRelease or ClusterHelmRelease are touched: pending upgrades and
+// rollbacks are rolled back to the last good revision, and pending installs
+// without one are purged so the next reconcile installs them from scratch.
+// Either way the release must carry the object's ownership marker.
+//
+// It reads HelmReleases through reader so it does not depend on the
+// manager's cache, and only recovers releases in r.Scope and r.Shard.
+func (r *HelmReleaseReconciler) RecoverPendingReleases(ctx context.Context, reader client.Reader) error {
+	pending, err := r.Helm.ListPending(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list pending helm releases")
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	byReleaseName := map[string]releaseObject{}
+	namespaces := r.Scope.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		var helmReleases operatorsv1alpha1.HelmReleaseList
+		if err := reader.List(ctx, &helmReleases, client.InNamespace(namespace)); err != nil {
+			return errors.Wrap(err, "failed to list HelmReleases")
+		}
+		for i := range helmReleases.Items {
+			helmRelease := &helmReleases.Items[i]
+			byReleaseName[helmRelease.GetReleaseName()] = helmRelease
+		}
+	}
+	if r.Scope.ContainsNamespace("") {
+		var clusterHelmReleases operatorsv1alpha1.ClusterHelmReleaseList
+		if err := reader.List(ctx, &clusterHelmReleases); err != nil {
+			return errors.Wrap(err, "failed to list ClusterHelmReleases")
+		}
+		for i := range clusterHelmReleases.Items {
+			helmRelease := &clusterHelmReleases.Items[i]
+			byReleaseName[helmRelease.GetReleaseName()] = helmRelease
+		}
+	}
+
+	for _, release := range pending {
+		log := r.Log.WithValues("release", release.Name, "status", release.Status)
+
+		helmRelease, ok := byReleaseName[release.Name]
+		if !ok || helmRelease.GetTargetNamespace() != release.Namespace {
+			log.Info("skipping pending release without a HelmRelease or ClusterHelmRelease")
+			continue
+		}
+		if !r.Scope.Contains(helmRelease) {
+			log.V(1).Info("skipping pending release outside the manager's scope")
+			continue
+		}
+		if !r.Shard.Owns(helmRelease) {
+			log.V(1).Info("skipping pending release of another shard")
+			continue
+		}
+
+		if err := r.recoverRelease(ctx, helmRelease); err != nil {
+			log.Error(err, "failed to recover pending release")
+			r.Recorder.Event(helmRelease, "Warning", "FailedRecovery", err.Error())
+			continue
+		}
+		log.Info("recovered pending release")
+	}
+	return nil
+}
+
+func (r *HelmReleaseReconciler) recoverRelease(ctx context.Context, helmRelease releaseObject) error {
+	timeout := releaseTimeout(helmRelease.GetReleaseSpec())
+	helmCtx, cancel := helm.TimeoutContext(ctx, timeout)
+	defer cancel()
+
+	releaseName := helmRelease.GetReleaseName()
+	revisions, err := r.Helm.History(helmCtx, releaseName)
+	if err != nil {
+		return errors.Wrap(err, "failed to get helm history")
+	}
+	good := lastGoodRevision(revisions)
+	if good != nil {
+		if !r.manages(helmRelease, revisions) {
+			r.Log.Info("skipping pending release which is not managed by its object", "release", releaseName)
+			return nil
+		}
+		r.Recorder.Eventf(helmRelease, "Normal", "Recovering", "Rolling back pending release to revision %d", good.Revision)
+		return r.Helm.Rollback(helmCtx, releaseName, good.Revision, timeout)
+	}
+
+	// A release which was never deployed has nothing to roll back to, so it
+	// is purged, but only if the interrupted install was our own: adoption
+	// does not apply to a release we would delete outright.
+	if releaseOwner(revisions) != ownerOf(helmRelease) {
+		r.Log.Info("skipping pending install which was not started by its object", "release", releaseName)
+		return nil
+	}
+	r.Recorder.Event(helmRelease, "Normal", "Recovering", "Purging pending release with no deployed revision")
+	return r.Helm.Delete(helmCtx, releaseName)
+}
+
+// lastGoodRevision returns the newest revision which was successfully
+// deployed at some point, or nil if there is none.
+func lastGoodRevision(revisions []helm.Revision) *helm.Revision {
+	var good *helm.Revision
+	for i := range revisions {
+		switch revisions[i].Status {
+		case helm.StatusDeployed, helm.StatusSuperseded:
+			if good == nil || revisions[i].Revision > good.Revision {
+				good = &revisions[i]
+			}
+		}
+	}
+	return good
+}
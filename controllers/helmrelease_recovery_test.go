@@ -0,0 +1,128 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// pendingHelm stands in for helm with releases interrupted in various states.
+// Rollbacks and deletions are appended to actions.
+const pendingHelm = `case "$1" in
+history)
+	case "$2" in
+	upgrade) echo '[{"revision":1,"status":"SUPERSEDED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/upgrade"},{"revision":2,"status":"DEPLOYED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/upgrade"},{"revision":3,"status":"PENDING_UPGRADE","description":"Managed by operators.alexeldeib.xyz HelmRelease default/upgrade"}]' ;;
+	foreign) echo '[{"revision":1,"status":"DEPLOYED","description":"Managed by operators.alexeldeib.xyz HelmRelease other/foreign"},{"revision":2,"status":"PENDING_UPGRADE","description":"Managed by operators.alexeldeib.xyz HelmRelease other/foreign"}]' ;;
+	install) echo '[{"revision":1,"status":"PENDING_INSTALL","description":"Managed by operators.alexeldeib.xyz HelmRelease default/install"}]' ;;
+	*) echo '[{"revision":1,"status":"PENDING_INSTALL","description":"Initial install underway"}]' ;;
+	esac ;;
+rollback) echo "rollback $2 $3" >> "$(dirname "$0")/actions" ;;
+delete) echo "delete $2" >> "$(dirname "$0")/actions" ;;
+esac
+`
+
+var _ = Describe("Pending release recovery", func() {
+	It("should find the newest revision which was deployed", func() {
+		Expect(lastGoodRevision(nil)).To(BeNil())
+		Expect(lastGoodRevision([]helm.Revision{
+			{Revision: 1, Status: helm.StatusFailed},
+			{Revision: 2, Status: helm.StatusPendingInstall},
+		})).To(BeNil())
+
+		good := lastGoodRevision([]helm.Revision{
+			{Revision: 1, Status: helm.StatusSuperseded},
+			{Revision: 3, Status: helm.StatusDeployed},
+			{Revision: 2, Status: helm.StatusSuperseded},
+			{Revision: 4, Status: helm.StatusFailed},
+			{Revision: 5, Status: helm.StatusPendingUpgrade},
+		})
+		Expect(good).NotTo(BeNil())
+		Expect(good.Revision).To(BeEquivalentTo(3))
+	})
+
+	Describe("recoverRelease", func() {
+		var (
+			dir      string
+			recorder *record.FakeRecorder
+			r        *HelmReleaseReconciler
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "recovery-test")
+			Expect(err).NotTo(HaveOccurred())
+			path := filepath.Join(dir, "helm")
+			Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+pendingHelm), 0700)).To(Succeed())
+
+			recorder = record.NewFakeRecorder(10)
+			r = &HelmReleaseReconciler{
+				Helm:     helm.New(path, logf.Log),
+				Recorder: recorder,
+				Log:      logf.Log,
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		recoverPending := func(name string) string {
+			helmRelease := &operatorsv1alpha1.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			}
+			Expect(r.recoverRelease(context.Background(), helmRelease)).To(Succeed())
+			actions, err := ioutil.ReadFile(filepath.Join(dir, "actions"))
+			if os.IsNotExist(err) {
+				return ""
+			}
+			Expect(err).NotTo(HaveOccurred())
+			return string(actions)
+		}
+
+		It("should roll a pending upgrade back to the last good revision", func() {
+			Expect(recoverPending("upgrade")).To(Equal("rollback upgrade 2\n"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("revision 2")))
+		})
+
+		It("should not roll back a release owned by another object", func() {
+			Expect(recoverPending("foreign")).To(BeEmpty())
+			Expect(recorder.Events).NotTo(Receive())
+		})
+
+		It("should purge a pending install it started", func() {
+			Expect(recoverPending("install")).To(Equal("delete install\n"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Purging")))
+		})
+
+		It("should not purge a pending install without its ownership marker", func() {
+			Expect(recoverPending("manual")).To(BeEmpty())
+			Expect(recorder.Events).NotTo(Receive())
+		})
+	})
+})
@@ -0,0 +1,170 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/alexeldeib/operators/pkg/metrics"
+	"github.com/alexeldeib/operators/pkg/redact"
+)
+
+// releaseValues holds everything passed to helm as values for a release.
+type releaseValues struct {
+	// documents are values files, in the order helm should apply them.
+	documents []string
+	overrides []string
+	// redactor masks every value which came from a Secret or a sensitive
+	// override.
+	redactor *redact.Redactor
+	// sources name each Secret and ConfigMap read, with its resource version.
+	sources []string
+}
+
+// hash identifies the versions of the values sources, or is empty if there
+// are none. Only names and resource versions are hashed, so it reveals
+// nothing of the values.
+func (v *releaseValues) hash() string {
+	if len(v.sources) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(v.sources, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Values sources are only read with get, directly from the API server, so
+// that the manager neither caches nor needs to watch every Secret.
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get
+
+// resolveValues gathers inline values, values from referenced Secrets and
+// ConfigMaps, and overrides for helmRelease. Errors are safe to surface: they
+// never include the content of a values source.
+func (r *HelmReleaseReconciler) resolveValues(ctx context.Context, helmRelease releaseObject) (*releaseValues, error) {
+	values := &releaseValues{redactor: redact.New()}
+	spec := helmRelease.GetReleaseSpec()
+	// A ClusterHelmRelease has no namespace of its own; its references are
+	// read from the namespace it installs into.
+	namespace := helmRelease.GetNamespace()
+	if namespace == "" {
+		namespace = helmRelease.GetTargetNamespace()
+	}
+
+	if spec.Values != "" {
+		values.documents = append(values.documents, spec.Values)
+	}
+
+	for _, ref := range spec.ValuesFrom {
+		switch {
+		case ref.SecretKeyRef != nil:
+			doc, version, err := r.secretValues(ctx, namespace, ref.SecretKeyRef)
+			if err != nil {
+				metrics.ValuesFetchFailures.WithLabelValues(helmRelease.GetNamespace(), helmRelease.GetName(), "secret").Inc()
+				return nil, err
+			}
+			values.sources = append(values.sources, "secret/"+ref.SecretKeyRef.Name+"/"+ref.SecretKeyRef.Key+"@"+version)
+			if doc == "" {
+				continue
+			}
+			var parsed interface{}
+			if err := yaml.Unmarshal([]byte(doc), &parsed); err != nil {
+				metrics.ValuesFetchFailures.WithLabelValues(helmRelease.GetNamespace(), helmRelease.GetName(), "secret").Inc()
+				return nil, errors.Errorf("secret %s key %s does not hold valid YAML", ref.SecretKeyRef.Name, ref.SecretKeyRef.Key)
+			}
+			values.redactor.Add(redact.ValuesOf(parsed)...)
+			values.documents = append(values.documents, doc)
+		case ref.ConfigMapKeyRef != nil:
+			doc, version, err := r.configMapValues(ctx, namespace, ref.ConfigMapKeyRef)
+			if err != nil {
+				metrics.ValuesFetchFailures.WithLabelValues(helmRelease.GetNamespace(), helmRelease.GetName(), "configmap").Inc()
+				return nil, err
+			}
+			values.sources = append(values.sources, "configmap/"+ref.ConfigMapKeyRef.Name+"/"+ref.ConfigMapKeyRef.Key+"@"+version)
+			if doc != "" {
+				values.documents = append(values.documents, doc)
+			}
+		default:
+			return nil, errors.New("valuesFrom entry must set secretKeyRef or configMapKeyRef")
+		}
+	}
+
+	values.overrides = append(values.overrides, spec.Overrides...)
+	for _, override := range spec.SensitiveOverrides {
+		values.redactor.Add(redact.OverrideValue(override))
+		values.overrides = append(values.overrides, override)
+	}
+	return values, nil
+}
+
+// secretValues returns the document under ref's key and the resource version
+// of its Secret, which is empty if an optional Secret does not exist.
+func (r *HelmReleaseReconciler) secretValues(ctx context.Context, namespace string, ref *corev1.SecretKeySelector) (string, string, error) {
+	optional := ref.Optional != nil && *ref.Optional
+	var secret corev1.Secret
+	if err := r.reader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &secret); err != nil {
+		if optional && ignoreNotFound(err) == nil {
+			return "", "", nil
+		}
+		return "", "", errors.Wrapf(err, "failed to get values secret %s", ref.Name)
+	}
+	data, ok := secret.Data[ref.Key]
+	if !ok {
+		if optional {
+			return "", secret.ResourceVersion, nil
+		}
+		return "", "", errors.Errorf("values secret %s has no key %s", ref.Name, ref.Key)
+	}
+	return string(data), secret.ResourceVersion, nil
+}
+
+// configMapValues returns the document under ref's key and the resource
+// version of its ConfigMap, which is empty if an optional ConfigMap does not
+// exist.
+func (r *HelmReleaseReconciler) configMapValues(ctx context.Context, namespace string, ref *corev1.ConfigMapKeySelector) (string, string, error) {
+	optional := ref.Optional != nil && *ref.Optional
+	var configMap corev1.ConfigMap
+	if err := r.reader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &configMap); err != nil {
+		if optional && ignoreNotFound(err) == nil {
+			return "", "", nil
+		}
+		return "", "", errors.Wrapf(err, "failed to get values configmap %s", ref.Name)
+	}
+	data, ok := configMap.Data[ref.Key]
+	if !ok {
+		if optional {
+			return "", configMap.ResourceVersion, nil
+		}
+		return "", "", errors.Errorf("values configmap %s has no key %s", ref.Name, ref.Key)
+	}
+	return data, configMap.ResourceVersion, nil
+}
+
+// reader returns the reader for values sources.
+func (r *HelmReleaseReconciler) reader() client.Reader {
+	if r.Reader != nil {
+		return r.Reader
+	}
+	return r.Client
+}
@@ -0,0 +1,148 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// deployedHelm stands in for helm with a release deployed by the HelmRelease
+// default/nginx. Each upgrade is appended to upgrades.
+const deployedHelm = `dir="$(dirname "$0")"
+case "$1" in
+history)
+	echo '[{"revision":1,"status":"DEPLOYED","description":"Managed by operators.alexeldeib.xyz HelmRelease default/nginx"}]' ;;
+upgrade)
+	echo upgrade >> "$dir/upgrades" ;;
+esac
+`
+
+var _ = Describe("HelmRelease values", func() {
+	var (
+		dir string
+		r   *HelmReleaseReconciler
+		key = types.NamespacedName{Name: "nginx", Namespace: "default"}
+	)
+
+	// secretReader serves the values Secret at resourceVersion.
+	secretReader := func(resourceVersion string) client.Reader {
+		s := runtime.NewScheme()
+		Expect(corev1.AddToScheme(s)).To(Succeed())
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx-values", Namespace: "default", ResourceVersion: resourceVersion},
+			Data:       map[string][]byte{"values.yaml": []byte("controller:\n  replicaCount: " + resourceVersion + "\n")},
+		}
+		return fake.NewFakeClientWithScheme(s, secret)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "values-test")
+		Expect(err).NotTo(HaveOccurred())
+		path := filepath.Join(dir, "helm")
+		Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+deployedHelm), 0700)).To(Succeed())
+
+		// The spec is deployed, but not yet with the values from the Secret.
+		helmRelease := &operatorsv1alpha1.HelmRelease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       "nginx",
+				Namespace:  "default",
+				Generation: 1,
+				Finalizers: []string{"helm.operators.alexeldeib.xyz"},
+			},
+			Spec: operatorsv1alpha1.HelmReleaseSpec{
+				Chart:           "stable/nginx-ingress",
+				TargetNamespace: "default",
+				ValuesFrom: []operatorsv1alpha1.ValuesReference{{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "nginx-values"},
+						Key:                  "values.yaml",
+					},
+				}},
+			},
+			Status: operatorsv1alpha1.HelmReleaseStatus{
+				ProvisioningState:     operatorsv1alpha1.ProvisioningStateSucceeded,
+				Revision:              1,
+				ObservedGeneration:    1,
+				LastAppliedGeneration: 1,
+			},
+		}
+		// The manager's client cannot read Secrets, so they must come from
+		// the Reader.
+		s := runtime.NewScheme()
+		Expect(operatorsv1alpha1.AddToScheme(s)).To(Succeed())
+		r = &HelmReleaseReconciler{
+			Client:   fake.NewFakeClientWithScheme(s, helmRelease),
+			Reader:   secretReader("1"),
+			Helm:     helm.New(path, logf.Log),
+			Recorder: record.NewFakeRecorder(10),
+			Log:      logf.Log,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	reconcile := func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	upgrades := func() int {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "upgrades"))
+		if os.IsNotExist(err) {
+			return 0
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Count(string(data), "upgrade")
+	}
+
+	It("should roll out changes to a Secret although the spec is unchanged", func() {
+		reconcile()
+		Expect(upgrades()).To(Equal(1))
+		var helmRelease operatorsv1alpha1.HelmRelease
+		Expect(r.Get(context.Background(), key, &helmRelease)).To(Succeed())
+		Expect(helmRelease.Status.LastAppliedValuesHash).NotTo(BeEmpty())
+
+		reconcile()
+		Expect(upgrades()).To(Equal(1), "nothing changed")
+
+		r.Reader = secretReader("2")
+		reconcile()
+		Expect(upgrades()).To(Equal(2))
+	})
+})
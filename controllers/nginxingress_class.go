@@ -0,0 +1,107 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// ingressClassHolder returns the NginxIngress which holds the ingress class
+// of nginxIngress, or nil if nginxIngress holds it itself. The webhook
+// rejects a second claim; without it, the oldest claim wins.
+func (r *NginxIngressReconciler) ingressClassHolder(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress) (*operatorsv1alpha1.NginxIngress, error) {
+	var list operatorsv1alpha1.NginxIngressList
+	if err := r.List(ctx, &list); err != nil {
+		return nil, err
+	}
+	var holder *operatorsv1alpha1.NginxIngress
+	for i := range list.Items {
+		other := &list.Items[i]
+		if other.GetIngressClass() != nginxIngress.GetIngressClass() || !claimsBefore(other, nginxIngress) {
+			continue
+		}
+		if holder == nil || claimsBefore(other, holder) {
+			holder = other
+		}
+	}
+	return holder, nil
+}
+
+// claimsBefore reports whether the claim of a on its ingress class predates
+// the claim of b. Ties are broken by key.
+func claimsBefore(a, b *operatorsv1alpha1.NginxIngress) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return objectKey(a) < objectKey(b)
+}
+
+// refuseIngressClass reports that the ingress class of nginxIngress is held
+// by holder. Nothing is deployed for nginxIngress meanwhile.
+func (r *NginxIngressReconciler) refuseIngressClass(ctx context.Context, nginxIngress, holder *operatorsv1alpha1.NginxIngress) error {
+	message := fmt.Sprintf("Ingress class %s is held by NginxIngress %s", nginxIngress.GetIngressClass(), objectKey(holder))
+	current := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionIngressClassConflict)
+	if current != nil && current.Status == corev1.ConditionTrue && current.Message == message {
+		return nil
+	}
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionIngressClassConflict,
+		Status:  corev1.ConditionTrue,
+		Reason:  "ClassInUse",
+		Message: message,
+	})
+	nginxIngress.Status.IngressClass = ""
+	r.Recorder.Event(nginxIngress, "Warning", "IngressClassConflict", message)
+	if err := r.Status().Update(ctx, nginxIngress); err != nil {
+		r.Log.Error(err, "unable to update NginxIngress status")
+		return err
+	}
+	return nil
+}
+
+// sameIngressClass maps an NginxIngress to the others claiming its ingress
+// class, so that one waiting for the class is reconciled when it is released.
+func (r *NginxIngressReconciler) sameIngressClass(obj handler.MapObject) []reconcile.Request {
+	nginxIngress, ok := obj.Object.(*operatorsv1alpha1.NginxIngress)
+	if !ok {
+		return nil
+	}
+	var list operatorsv1alpha1.NginxIngressList
+	if err := r.List(context.Background(), &list); err != nil {
+		r.Log.Error(err, "unable to list NginxIngresses sharing an ingress class")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, other := range list.Items {
+		if other.Namespace == nginxIngress.Namespace && other.Name == nginxIngress.Name {
+			continue
+		}
+		if other.GetIngressClass() == nginxIngress.GetIngressClass() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: other.Namespace, Name: other.Name},
+			})
+		}
+	}
+	return requests
+}
@@ -16,15 +16,15 @@ limitations under the License.
 package controllers
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"net/http"
-	"text/template"
 	"time"
 
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -32,9 +32,13 @@ import (
 	"k8s.io/helm/pkg/helm"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	cloudv1alpha1 "github.com/alexeldeib/cloud/api/v1alpha1"
 	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/config"
 )
 
 // NginxIngressReconciler reconciles a NginxIngress object
@@ -44,6 +48,12 @@ type NginxIngressReconciler struct {
 	Recorder   record.EventRecorder
 	Scheme     *runtime.Scheme
 	HelmClient helm.Interface
+	// Config holds the default chart and the load balancer poll interval.
+	Config *config.Store
+	// Scope limits the NginxIngresses reconciled by this manager instance.
+	Scope Scope
+	// Shard limits the NginxIngresses reconciled by this replica.
+	Shard Shard
 }
 
 // +kubebuilder:rbac:groups=operators.alexeldeib.xyz,resources=nginxingresses,verbs=get;list;watch;create;delete;update;patch
@@ -53,25 +63,69 @@ type NginxIngressReconciler struct {
 func (r *NginxIngressReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
 	log := r.Log.WithValues("nginxingress", req.NamespacedName)
+	cfg := r.Config.Get()
 
 	var nginxIngress operatorsv1alpha1.NginxIngress
 	if err := r.Get(ctx, req.NamespacedName, &nginxIngress); err != nil {
 		return ctrl.Result{}, ignoreNotFound(err)
 	}
+	// The event filters only see the object which triggered a watch, so
+	// requests mapped from another NginxIngress or a PublicIP may name one
+	// this replica is not responsible for.
+	if !r.Scope.Contains(&nginxIngress) {
+		log.V(1).Info("skipping NginxIngress outside the manager's scope")
+		return ctrl.Result{}, nil
+	}
+	if !r.Shard.Owns(&nginxIngress) {
+		log.V(1).Info("skipping NginxIngress of another shard")
+		return ctrl.Result{}, nil
+	}
 
-	_ = "nginxingress.operators.alexeldeib.xyz"
-	// TODO(ace): finalizer deletion logic
-
-	// existing IP and Helm Release
-	var existingIP cloudv1alpha1.PublicIP
-	var existingIPErr error
-	if existingIPErr = r.Get(ctx, req.NamespacedName, &existingIP); existingIPErr != nil {
-		if !apierrs.IsNotFound(existingIPErr) {
-			return ctrl.Result{RequeueAfter: time.Second * 5}, existingIPErr
+	if !nginxIngress.DeletionTimestamp.IsZero() {
+		return r.teardown(ctx, log, &nginxIngress)
+	}
+	if !containsString(nginxIngress.Finalizers, nginxIngressFinalizer) {
+		nginxIngress.Finalizers = append(nginxIngress.Finalizers, nginxIngressFinalizer)
+		if err := r.Update(ctx, &nginxIngress); err != nil {
+			log.Error(err, "unable to add finalizer")
+			return ctrl.Result{}, err
 		}
 	}
 
-	nginxIngress.Status.PublicIPReady = existingIP.Status.ProvisioningState == "Succeeded"
+	holder, err := r.ingressClassHolder(ctx, &nginxIngress)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if holder != nil {
+		log.Info("ingress class is held by another NginxIngress", "class", nginxIngress.GetIngressClass(), "holder", objectKey(holder))
+		return ctrl.Result{}, r.refuseIngressClass(ctx, &nginxIngress, holder)
+	}
+
+	// Reconcile publicIP. An internal load balancer has none, and one
+	// referenced by resource ID is left to the cloud provider; PublicIPs
+	// created before are released once the load balancer has moved.
+	internal := nginxIngress.IsInternal()
+	ref := nginxIngress.GetPublicIPRef()
+	unobserved := ref != nil && ref.ResourceID != ""
+	var publicIP *cloudv1alpha1.PublicIP
+	var staleIPs []cloudv1alpha1.PublicIP
+	switch {
+	case internal || unobserved:
+		staleIPs, err = r.ownedPublicIPs(ctx, &nginxIngress)
+	case ref != nil:
+		publicIP, staleIPs, err = r.referencedPublicIP(ctx, log, &nginxIngress, ref.Name)
+	default:
+		publicIP, staleIPs, err = r.reconcilePublicIP(ctx, log, &nginxIngress)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// A referenced PublicIP still controlled by another object, e.g. another
+	// NginxIngress, would be deleted or moved under this load balancer.
+	if owner := publicIPController(publicIP); ref != nil && owner != nil {
+		log.Info("referenced public IP is controlled by another object", "IP", publicIP.Name, "controller", owner.Name)
+		return ctrl.Result{}, r.refusePublicIP(ctx, &nginxIngress, publicIP, owner)
+	}
 
 	var existingRelease operatorsv1alpha1.HelmRelease
 	var existingReleaseErr error
@@ -79,75 +133,114 @@ func (r *NginxIngressReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 		if !apierrs.IsNotFound(existingReleaseErr) {
 			return ctrl.Result{}, existingReleaseErr
 		}
+	} else if !metav1.IsControlledBy(&existingRelease, &nginxIngress) {
+		log.Info("helm release is not controlled by this NginxIngress", "helmrelease", objectKey(&existingRelease))
+		return ctrl.Result{}, r.refuseHelmRelease(ctx, &nginxIngress, &existingRelease)
+	}
+
+	nginxIngress.Status.PublicIPReady = publicIPReady(publicIP)
+	if !internal && !unobserved {
+		operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, readyCondition(operatorsv1alpha1.ConditionPublicIPReady, nginxIngress.Status.PublicIPReady))
 	}
 
 	// TODO(ace): stop duplicating this logic and implement ProvisioningState == succeeded in a helper
 	nginxIngress.Status.HelmReleaseReady = existingRelease.Status.ProvisioningState == "Succeeded"
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, readyCondition(operatorsv1alpha1.ConditionReleaseReady, nginxIngress.Status.HelmReleaseReady))
+
+	// Hold the release back until the address is allocated; installed with an
+	// empty loadBalancerIP, Azure would assign a random dynamic address.
+	var allocated bool
+	var allocationWait time.Duration
+	switch {
+	case internal:
+		allocated = true
+		setPublicIPUnobserved(&nginxIngress.Status.Conditions, corev1.ConditionFalse, "InternalLoadBalancer",
+			"An internal load balancer has no public IP")
+	case unobserved:
+		allocated = true
+		setPublicIPUnobserved(&nginxIngress.Status.Conditions, corev1.ConditionUnknown, "ResourceID",
+			fmt.Sprintf("Public IP %s has no PublicIP object; LoadBalancerReady reports whether the load balancer uses it", ref.ResourceID))
+	default:
+		allocated = nginxIngress.Status.PublicIPReady && publicIP.Status.IPAddress != ""
+		allocationWait = r.waitForPublicIP(&nginxIngress, publicIP, allocated, cfg.Timeouts.PublicIPAllocation.Duration)
+	}
+
+	var address string
+	var balancers []corev1.Service
+	if allocated {
+		if balancers, err = r.loadBalancers(ctx, &nginxIngress); err != nil {
+			return ctrl.Result{}, err
+		}
+		switch {
+		case internal && nginxIngress.Spec.LoadBalancer.IPAddress != "":
+			address = nginxIngress.Spec.LoadBalancer.IPAddress
+		case internal || unobserved:
+			address = balancerAddress(balancers)
+		default:
+			address = publicIP.Status.IPAddress
+		}
+	}
+	loadBalancer := loadBalancerCondition(balancers, address, internal || unobserved)
+	loadBalancerReady := loadBalancer.Status == corev1.ConditionTrue
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, loadBalancer)
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, readyCondition(operatorsv1alpha1.ConditionReady,
+		(internal || unobserved || nginxIngress.Status.PublicIPReady) && nginxIngress.Status.HelmReleaseReady && loadBalancerReady))
+	nginxIngress.Status.IPAddress = address
+	nginxIngress.Status.FQDN = ""
+	if allocated && publicIP != nil {
+		nginxIngress.Status.FQDN = publicIPFQDN(publicIP)
+	}
+	nginxIngress.Status.IngressClass = nginxIngress.GetIngressClass()
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, operatorsv1alpha1.Condition{
+		Type:   operatorsv1alpha1.ConditionIngressClassConflict,
+		Status: corev1.ConditionFalse,
+		Reason: "ClassHeld",
+	})
+
+	// Addresses assigned by Azure are not pinned.
+	loadBalancerIP := address
+	if internal || unobserved {
+		loadBalancerIP = nginxIngress.Spec.LoadBalancer.IPAddress
+	}
+	overrides, err := managedOverrides(&nginxIngress, loadBalancerIP)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	values, overridden, err := nginxIngressValues(&nginxIngress, overrides, managedAnnotations(&nginxIngress, publicIP))
+	if err != nil {
+		log.Error(err, "unable to render values for nginxRelease")
+		return ctrl.Result{}, err
+	}
+	r.reportOverriddenValues(&nginxIngress, overridden)
 
 	// Set status
 	log.Info("trying to update status")
 	if err := r.Status().Update(ctx, &nginxIngress); err != nil {
 		log.Error(err, "unable to update NginxIngress status")
-		return ctrl.Result{RequeueAfter: time.Second * 5}, err
-	}
-
-	// Reconcile publicIP
-	publicIPPrefix := fmt.Sprintf("%s-%s-%s-ingress", nginxIngress.Spec.ResourceGroup, nginxIngress.Namespace, nginxIngress.Name)
-
-	publicIP := cloudv1alpha1.PublicIP{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      nginxIngress.Name,
-			Namespace: nginxIngress.Namespace,
-		},
-		Spec: cloudv1alpha1.PublicIPSpec{
-			SubscriptionID:   nginxIngress.Spec.SubscriptionID,
-			ResourceGroup:    nginxIngress.Spec.ResourceGroup,
-			Location:         nginxIngress.Spec.Location,
-			AllocationMethod: "static",
-			DomainNameLabel:  publicIPPrefix,
-		},
-	}
-
-	if err := ctrl.SetControllerReference(&nginxIngress, &publicIP, r.Scheme); err != nil {
-		log.Error(err, "unable to set controller owner reference for IP")
 		return ctrl.Result{}, err
 	}
 
-	if existingIPErr != nil && apierrs.IsNotFound(existingIPErr) {
-		if err := r.Create(ctx, &publicIP); err != nil {
-			log.Error(err, "unable to create publicIP for nginxRelease", "IP", existingIP)
-			return ctrl.Result{}, err
-		}
-		// Requeue after IP successfully created
-		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	// The IP is watched, so its allocation triggers the next pass; requeue
+	// only to report the timeout. During a cut-over the release keeps the
+	// address being replaced meanwhile.
+	if !allocated {
+		log.Info("waiting for public IP to be allocated")
+		return ctrl.Result{RequeueAfter: allocationWait}, nil
 	}
 	// End reconcile publicIP
 
-	log.Info("starting to template publicIP")
-	// Template in static IP for load balancer
 	// TODO(ace): refactor as publicIP.Reconcile, helmRelease.Reconcile, move all peripheral logic to helpers
-	var publicIPOverride bytes.Buffer
-	publicIPOverrideTmpl := "controller.service.loadBalancerIP={{ .PublicIP }}"
-	tmpl := template.Must(template.New("ipoverride").Parse(publicIPOverrideTmpl))
-
-	params := map[string]string{
-		"PublicIP": existingIP.Status.IPAddress,
-	}
-	log.Info("executing template")
-	if err := tmpl.Execute(&publicIPOverride, params); err != nil {
-		log.Error(err, "Failed templating public IP override")
-	}
-
-	overrides := []string{publicIPOverride.String()}
-
 	// Reconcile helm chart for nginx
 	helmRelease := operatorsv1alpha1.HelmRelease{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      nginxIngress.Name,
 			Namespace: nginxIngress.Namespace,
+			Labels:    childLabels(&nginxIngress),
 		},
 		Spec: operatorsv1alpha1.HelmReleaseSpec{
-			Chart:     "stable/nginx-ingress",
+			Chart:     nginxIngressChart(&nginxIngress, cfg.Charts.NginxIngress),
+			Version:   nginxIngress.Spec.Version,
+			Values:    values,
 			Overrides: overrides,
 		},
 	}
@@ -166,7 +259,46 @@ func (r *NginxIngressReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 			return ctrl.Result{Requeue: true}, err
 		}
 		log.Info("release created without errors")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+		return ctrl.Result{}, nil
+	}
+
+	if shouldUpdateHelmRelease(existingRelease, helmRelease) {
+		// Only the fields set by this controller are replaced, so defaults
+		// filled in by the HelmRelease webhook are kept.
+		existingRelease.Labels = helmRelease.Labels
+		existingRelease.Spec.Chart = helmRelease.Spec.Chart
+		existingRelease.Spec.Version = helmRelease.Spec.Version
+		existingRelease.Spec.Values = helmRelease.Spec.Values
+		existingRelease.Spec.Overrides = helmRelease.Spec.Overrides
+		if err := r.Update(ctx, &existingRelease); err != nil {
+			log.Error(err, "unable to update helmRelease for nginxRelease")
+			return ctrl.Result{}, err
+		}
+		log.Info("release updated without errors")
+		return ctrl.Result{}, nil
+	}
+
+	// Load balancer Services are not watched, so the end of a cut-over is
+	// polled for.
+	if len(staleIPs) > 0 {
+		var replacement string
+		switch {
+		case internal:
+			replacement = "an internal load balancer"
+		case unobserved:
+			replacement = "public IP " + ref.ResourceID
+		default:
+			replacement = "PublicIP " + publicIP.Name
+		}
+		done, err := r.finishCutOver(ctx, log, &nginxIngress, &existingRelease, replacement, staleIPs)
+		if err != nil || !done {
+			return ctrl.Result{RequeueAfter: cfg.Resync.LoadBalancerPoll.Duration}, err
+		}
+	}
+
+	// Neither is the load balancer coming up on the address.
+	if nginxIngress.Status.HelmReleaseReady && !loadBalancerReady {
+		return ctrl.Result{RequeueAfter: cfg.Resync.LoadBalancerPoll.Duration}, nil
 	}
 
 	return ctrl.Result{}, nil
@@ -175,6 +307,15 @@ func (r *NginxIngressReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error
 func (r *NginxIngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&operatorsv1alpha1.NginxIngress{}).
+		Owns(&cloudv1alpha1.PublicIP{}).
+		Owns(&operatorsv1alpha1.HelmRelease{}).
+		Watches(&source.Kind{Type: &cloudv1alpha1.PublicIP{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.referencingPublicIP)}).
+		Watches(&source.Kind{Type: &operatorsv1alpha1.NginxIngress{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.sameIngressClass)}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.Get().Concurrency.NginxIngresses}).
+		WithEventFilter(r.Scope.Predicate()).
+		WithEventFilter(r.Shard.Predicate()).
 		Complete(r)
 }
 
@@ -194,31 +335,97 @@ func IsNotFound(err error) bool {
 	return false
 }
 
-func shouldUpdateIP(actual, desired cloudv1alpha1.PublicIP) bool {
-	if actual.Spec.SubscriptionID != desired.Spec.SubscriptionID {
-		return true
+// refuseHelmRelease reports that a HelmRelease named after nginxIngress
+// exists but belongs to someone else. It is left as it is; nginxIngress
+// deploys nothing until it is removed.
+func (r *NginxIngressReconciler) refuseHelmRelease(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress, helmRelease *operatorsv1alpha1.HelmRelease) error {
+	message := fmt.Sprintf("HelmRelease %s exists and is not controlled by this NginxIngress", objectKey(helmRelease))
+	current := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionReleaseReady)
+	if current != nil && current.Status == corev1.ConditionFalse && current.Message == message {
+		return nil
 	}
-	if actual.Spec.ResourceGroup != desired.Spec.ResourceGroup {
-		return true
+	nginxIngress.Status.HelmReleaseReady = false
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionReleaseReady,
+		Status:  corev1.ConditionFalse,
+		Reason:  "ReleaseNotControlled",
+		Message: message,
+	})
+	r.Recorder.Event(nginxIngress, "Warning", "ReleaseConflict", message)
+	if err := r.Status().Update(ctx, nginxIngress); err != nil {
+		r.Log.Error(err, "unable to update NginxIngress status")
+		return err
 	}
-	if actual.Spec.Location != desired.Spec.Location {
-		return true
+	return nil
+}
+
+// readyCondition returns a condition of type t reflecting ready.
+func readyCondition(t operatorsv1alpha1.ConditionType, ready bool) operatorsv1alpha1.Condition {
+	if ready {
+		return operatorsv1alpha1.Condition{Type: t, Status: corev1.ConditionTrue}
+	}
+	return operatorsv1alpha1.Condition{Type: t, Status: corev1.ConditionFalse}
+}
+
+// nginxIngressChart returns the chart to install for nginxIngress, or the
+// configured default chart for objects stored before defaulting was
+// introduced, which have no chart set.
+func nginxIngressChart(nginxIngress *operatorsv1alpha1.NginxIngress, defaultChart string) string {
+	if nginxIngress.Spec.Chart != "" {
+		return nginxIngress.Spec.Chart
+	}
+	return defaultChart
+}
+
+// childLabels returns the labels for objects created for nginxIngress. They
+// are copied from nginxIngress, so a manager scoped by label selector or
+// sharded by label also handles its children.
+func childLabels(nginxIngress *operatorsv1alpha1.NginxIngress) map[string]string {
+	if len(nginxIngress.Labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(nginxIngress.Labels))
+	for k, v := range nginxIngress.Labels {
+		labels[k] = v
 	}
+	return labels
+}
+
+// shouldUpdateIP reports whether the mutable fields of actual differ from
+// desired.
+func shouldUpdateIP(actual, desired cloudv1alpha1.PublicIP) bool {
 	if actual.Spec.DomainNameLabel != desired.Spec.DomainNameLabel {
 		return true
 	}
 	if actual.Spec.AllocationMethod != desired.Spec.AllocationMethod {
 		return true
 	}
-	return false
+	return !equality.Semantic.DeepEqual(actual.Labels, desired.Labels)
 }
 
+// shouldReplaceIP reports whether actual differs from desired in a field
+// Azure cannot change on an existing public IP.
+func shouldReplaceIP(actual, desired cloudv1alpha1.PublicIP) bool {
+	if actual.Spec.SubscriptionID != desired.Spec.SubscriptionID {
+		return true
+	}
+	if actual.Spec.ResourceGroup != desired.Spec.ResourceGroup {
+		return true
+	}
+	return actual.Spec.Location != desired.Spec.Location
+}
+
+// shouldUpdateHelmRelease reports whether the fields of actual managed by the
+// NginxIngress controller differ from desired.
 func shouldUpdateHelmRelease(actual, desired operatorsv1alpha1.HelmRelease) bool {
-	if actual.Spec.Chart != desired.Spec.Chart {
+	if actual.Spec.Chart != desired.Spec.Chart || actual.Spec.Version != desired.Spec.Version {
 		return true
 	}
-	if actual.Spec.Values != desired.Spec.Chart {
+	if actual.Spec.Values != desired.Spec.Values {
 		return true
 	}
-	return false
+	if !equality.Semantic.DeepEqual(actual.Spec.Overrides, desired.Spec.Overrides) {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(actual.Labels, desired.Labels)
 }
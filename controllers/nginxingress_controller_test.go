@@ -0,0 +1,787 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	cloudv1alpha1 "github.com/alexeldeib/cloud/api/v1alpha1"
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/config"
+)
+
+// nginxIngressScheme registers every type the NginxIngress controller reads.
+func nginxIngressScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	Expect(corev1.AddToScheme(s)).To(Succeed())
+	Expect(operatorsv1alpha1.AddToScheme(s)).To(Succeed())
+	Expect(cloudv1alpha1.AddToScheme(s)).To(Succeed())
+	return s
+}
+
+var _ = Describe("NginxIngress teardown", func() {
+	var (
+		ctx      context.Context
+		key      types.NamespacedName
+		s        *runtime.Scheme
+		ingress  *operatorsv1alpha1.NginxIngress
+		release  *operatorsv1alpha1.HelmRelease
+		publicIP *cloudv1alpha1.PublicIP
+		service  *corev1.Service
+		c        client.Client
+		recorder *record.FakeRecorder
+		r        *NginxIngressReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		key = types.NamespacedName{Namespace: "default", Name: "edge"}
+		now := metav1.Now()
+		meta := metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}
+
+		ingress = &operatorsv1alpha1.NginxIngress{ObjectMeta: *meta.DeepCopy()}
+		ingress.UID = "edge-uid"
+		ingress.DeletionTimestamp = &now
+		ingress.Finalizers = []string{nginxIngressFinalizer}
+		s = nginxIngressScheme()
+		release = &operatorsv1alpha1.HelmRelease{ObjectMeta: *meta.DeepCopy()}
+		Expect(ctrl.SetControllerReference(ingress, release, s)).To(Succeed())
+		publicIP = &cloudv1alpha1.PublicIP{ObjectMeta: *meta.DeepCopy()}
+		Expect(ctrl.SetControllerReference(ingress, publicIP, s)).To(Succeed())
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "edge-nginx-ingress-controller",
+				Namespace: key.Namespace,
+				Labels:    map[string]string{releaseLabel: key.Name},
+			},
+			Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		}
+	})
+
+	JustBeforeEach(func() {
+		objs := []runtime.Object{ingress, release, publicIP, service}
+		c = fake.NewFakeClientWithScheme(s, objs...)
+		recorder = record.NewFakeRecorder(10)
+		r = &NginxIngressReconciler{Client: c, Log: logf.Log, Recorder: recorder}
+	})
+
+	reconcile := func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	step := func() string {
+		var ingress operatorsv1alpha1.NginxIngress
+		Expect(c.Get(ctx, key, &ingress)).To(Succeed())
+		condition := operatorsv1alpha1.FindCondition(ingress.Status.Conditions, operatorsv1alpha1.ConditionTerminating)
+		Expect(condition).NotTo(BeNil())
+		return condition.Reason
+	}
+
+	exists := func(obj childObject) bool {
+		err := c.Get(ctx, key, obj)
+		if apierrs.IsNotFound(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	It("should release the public IP only after the load balancer is gone", func() {
+		reconcile()
+		Expect(step()).To(Equal(reasonDeletingRelease))
+		Expect(exists(&operatorsv1alpha1.HelmRelease{})).To(BeFalse())
+		Expect(exists(&cloudv1alpha1.PublicIP{})).To(BeTrue())
+
+		reconcile()
+		Expect(step()).To(Equal(reasonWaitingForLoadBalancer))
+		Expect(exists(&cloudv1alpha1.PublicIP{})).To(BeTrue())
+
+		// The cloud provider removes the Service once its rule is gone.
+		Expect(c.Delete(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+			Name: "edge-nginx-ingress-controller", Namespace: key.Namespace,
+		}})).To(Succeed())
+		reconcile()
+		Expect(step()).To(Equal(reasonDeletingPublicIP))
+		Expect(exists(&cloudv1alpha1.PublicIP{})).To(BeFalse())
+		Expect(recorder.Events).To(HaveLen(3))
+
+		reconcile()
+		var ingress operatorsv1alpha1.NginxIngress
+		if err := c.Get(ctx, key, &ingress); !apierrs.IsNotFound(err) {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ingress.Finalizers).NotTo(ContainElement(nginxIngressFinalizer))
+		}
+	})
+
+	Context("with a HelmRelease it does not control", func() {
+		BeforeEach(func() {
+			release.OwnerReferences = nil
+		})
+
+		It("should leave the HelmRelease alone", func() {
+			reconcile()
+			Expect(step()).To(Equal(reasonWaitingForLoadBalancer))
+			Expect(exists(&operatorsv1alpha1.HelmRelease{})).To(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("not controlled by this NginxIngress")))
+		})
+	})
+
+	Context("with a chart using the recommended labels", func() {
+		BeforeEach(func() {
+			service.Labels = map[string]string{instanceLabel: key.Name}
+		})
+
+		It("should wait for its load balancer", func() {
+			reconcile()
+			reconcile()
+			Expect(step()).To(Equal(reasonWaitingForLoadBalancer))
+			Expect(exists(&cloudv1alpha1.PublicIP{})).To(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("NginxIngress children", func() {
+	var (
+		ctx      context.Context
+		key      types.NamespacedName
+		s        *runtime.Scheme
+		ingress  *operatorsv1alpha1.NginxIngress
+		oldIP    *cloudv1alpha1.PublicIP
+		release  *operatorsv1alpha1.HelmRelease
+		service  *corev1.Service
+		holder   *operatorsv1alpha1.NginxIngress
+		partner  *cloudv1alpha1.PublicIP
+		recorder *record.FakeRecorder
+		c        client.Client
+		r        *NginxIngressReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		key = types.NamespacedName{Namespace: "default", Name: "edge"}
+		s = nginxIngressScheme()
+		holder = nil
+		partner = nil
+		meta := metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}
+
+		ingress = &operatorsv1alpha1.NginxIngress{
+			ObjectMeta: *meta.DeepCopy(),
+			Spec: operatorsv1alpha1.NginxIngressSpec{
+				SubscriptionID: "sub",
+				ResourceGroup:  "rg",
+				Location:       "westus2",
+			},
+		}
+		ingress.UID = "edge-uid"
+		ingress.Finalizers = []string{nginxIngressFinalizer}
+
+		oldIP = &cloudv1alpha1.PublicIP{
+			ObjectMeta: *meta.DeepCopy(),
+			Spec:       desiredPublicIP(ingress).Spec,
+			Status:     cloudv1alpha1.PublicIPStatus{ProvisioningState: "Succeeded", IPAddress: "10.0.0.1"},
+		}
+		Expect(ctrl.SetControllerReference(ingress, oldIP, s)).To(Succeed())
+
+		release = &operatorsv1alpha1.HelmRelease{
+			ObjectMeta: *meta.DeepCopy(),
+			Spec: operatorsv1alpha1.HelmReleaseSpec{
+				Chart: operatorsv1alpha1.DefaultNginxIngressChart,
+				Overrides: []string{
+					"controller.service.loadBalancerIP=10.0.0.1",
+					"controller.ingressClass=nginx",
+					"controller.electionID=ingress-controller-leader-nginx",
+				},
+			},
+			Status: operatorsv1alpha1.HelmReleaseStatus{ProvisioningState: operatorsv1alpha1.ProvisioningStateSucceeded},
+		}
+		Expect(ctrl.SetControllerReference(ingress, release, s)).To(Succeed())
+
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "edge-nginx-ingress-controller",
+				Namespace: key.Namespace,
+				Labels:    map[string]string{releaseLabel: key.Name},
+			},
+			Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}},
+			}},
+		}
+		recorder = record.NewFakeRecorder(10)
+	})
+
+	JustBeforeEach(func() {
+		objs := []runtime.Object{ingress, oldIP, release, service}
+		if holder != nil {
+			objs = append(objs, holder)
+		}
+		if partner != nil {
+			objs = append(objs, partner)
+		}
+		c = fake.NewFakeClientWithScheme(s, objs...)
+		r = &NginxIngressReconciler{Client: c, Log: logf.Log, Recorder: recorder, Scheme: s}
+	})
+
+	reconcile := func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should report the address, DNS name and readiness", func() {
+		reconcile()
+		var updated operatorsv1alpha1.NginxIngress
+		Expect(c.Get(ctx, key, &updated)).To(Succeed())
+		Expect(updated.Status.IPAddress).To(Equal("10.0.0.1"))
+		Expect(updated.Status.FQDN).To(Equal("rg-default-edge-ingress.westus2.cloudapp.azure.com"))
+		Expect(updated.Status.IngressClass).To(Equal("nginx"))
+		Expect(operatorsv1alpha1.IsConditionTrue(updated.Status.Conditions, operatorsv1alpha1.ConditionLoadBalancerReady)).To(BeTrue())
+		Expect(operatorsv1alpha1.IsConditionTrue(updated.Status.Conditions, operatorsv1alpha1.ConditionReady)).To(BeTrue())
+
+		Expect(c.Get(ctx, types.NamespacedName{Namespace: key.Namespace, Name: service.Name}, service)).To(Succeed())
+		service.Status.LoadBalancer.Ingress = nil
+		Expect(c.Status().Update(ctx, service)).To(Succeed())
+		result, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically(">", 0), "the load balancer is polled")
+		Expect(c.Get(ctx, key, &updated)).To(Succeed())
+		Expect(operatorsv1alpha1.FindCondition(updated.Status.Conditions, operatorsv1alpha1.ConditionLoadBalancerReady).Reason).To(Equal("Provisioning"))
+		Expect(operatorsv1alpha1.IsConditionTrue(updated.Status.Conditions, operatorsv1alpha1.ConditionReady)).To(BeFalse())
+	})
+
+	Context("when the children drift", func() {
+		BeforeEach(func() {
+			oldIP.Spec.DomainNameLabel = "renamed"
+			release.Spec.Chart = "mirror/nginx-ingress"
+			release.Spec.Values = "controller:\n  replicaCount: 5\n"
+			release.Spec.Timeout = &metav1.Duration{Duration: time.Minute}
+		})
+
+		It("should restore the fields it manages", func() {
+			reconcile()
+			var ip cloudv1alpha1.PublicIP
+			Expect(c.Get(ctx, key, &ip)).To(Succeed())
+			Expect(ip.Spec.DomainNameLabel).To(Equal("rg-default-edge-ingress"))
+
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Chart).To(Equal(operatorsv1alpha1.DefaultNginxIngressChart))
+			Expect(updated.Spec.Values).To(BeEmpty())
+			Expect(updated.Spec.Timeout).NotTo(BeNil(), "fields set by the webhook are kept")
+		})
+	})
+
+	Context("when a HelmRelease of the same name belongs to someone else", func() {
+		BeforeEach(func() {
+			release.OwnerReferences = nil
+			release.Spec.Chart = "mirror/nginx-ingress"
+		})
+
+		It("should report the conflict without taking it over", func() {
+			reconcile()
+			var updated operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			condition := operatorsv1alpha1.FindCondition(updated.Status.Conditions, operatorsv1alpha1.ConditionReleaseReady)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(corev1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("ReleaseNotControlled"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("ReleaseConflict")))
+
+			var unchanged operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &unchanged)).To(Succeed())
+			Expect(unchanged.Spec.Chart).To(Equal("mirror/nginx-ingress"))
+			Expect(unchanged.OwnerReferences).To(BeEmpty())
+		})
+	})
+
+	Context("when it belongs to another manager or replica", func() {
+		BeforeEach(func() {
+			release.Spec.Chart = "mirror/nginx-ingress"
+		})
+
+		It("should leave it and its children alone", func() {
+			shard := Shard{Count: 2}
+			if shard.Owns(ingress) {
+				shard.Index = 1
+			}
+			for _, limit := range []func(){
+				func() { r.Scope = Scope{Namespaces: []string{"other"}} },
+				func() { r.Shard = shard },
+			} {
+				r.Scope, r.Shard = Scope{}, Shard{}
+				limit()
+				reconcile()
+				var unchanged operatorsv1alpha1.HelmRelease
+				Expect(c.Get(ctx, key, &unchanged)).To(Succeed())
+				Expect(unchanged.Spec.Chart).To(Equal("mirror/nginx-ingress"))
+				var updated operatorsv1alpha1.NginxIngress
+				Expect(c.Get(ctx, key, &updated)).To(Succeed())
+				Expect(updated.Status.Conditions).To(BeEmpty())
+			}
+		})
+	})
+
+	Context("when another NginxIngress holds the ingress class", func() {
+		BeforeEach(func() {
+			ingress.CreationTimestamp = metav1.Now()
+			holder = &operatorsv1alpha1.NginxIngress{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "public",
+					Namespace:         "edge",
+					CreationTimestamp: metav1.NewTime(ingress.CreationTimestamp.Add(-time.Hour)),
+				},
+			}
+			release.Spec.Chart = "mirror/nginx-ingress"
+		})
+
+		It("should wait for the class without touching its children", func() {
+			reconcile()
+			var updated operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			conflict := operatorsv1alpha1.FindCondition(updated.Status.Conditions, operatorsv1alpha1.ConditionIngressClassConflict)
+			Expect(conflict).NotTo(BeNil())
+			Expect(conflict.Status).To(Equal(corev1.ConditionTrue))
+			Expect(conflict.Message).To(ContainSubstring("edge/public"))
+			Expect(updated.Status.IngressClass).To(BeEmpty())
+			Expect(recorder.Events).To(Receive(ContainSubstring("IngressClassConflict")))
+
+			var unchanged operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &unchanged)).To(Succeed())
+			Expect(unchanged.Spec.Chart).To(Equal("mirror/nginx-ingress"))
+
+			Expect(c.Delete(ctx, holder)).To(Succeed())
+			reconcile()
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(operatorsv1alpha1.IsConditionTrue(updated.Status.Conditions, operatorsv1alpha1.ConditionIngressClassConflict)).To(BeFalse())
+			Expect(updated.Status.IngressClass).To(Equal("nginx"))
+		})
+
+		Context("and it claims another class", func() {
+			BeforeEach(func() {
+				ingress.Spec.IngressClass = "internal"
+			})
+
+			It("should serve a class of its own", func() {
+				reconcile()
+				var updated operatorsv1alpha1.HelmRelease
+				Expect(c.Get(ctx, key, &updated)).To(Succeed())
+				Expect(updated.Spec.Overrides).To(ContainElement("controller.ingressClass=internal"))
+				Expect(updated.Spec.Overrides).To(ContainElement("controller.electionID=ingress-controller-leader-internal"))
+				Expect(updated.Spec.Overrides).NotTo(ContainElement(HavePrefix("controller.scope.")), "every namespace is watched")
+			})
+		})
+	})
+
+	Context("when the controller is scoped", func() {
+		BeforeEach(func() {
+			ingress.Spec.Scope = &operatorsv1alpha1.NginxScope{}
+		})
+
+		It("should watch the namespace of the NginxIngress", func() {
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.scope.enabled=true"))
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.scope.namespace=default"))
+		})
+
+		Context("to another namespace", func() {
+			BeforeEach(func() {
+				ingress.Spec.Scope.Namespace = "apps"
+			})
+
+			It("should watch that namespace", func() {
+				reconcile()
+				var updated operatorsv1alpha1.HelmRelease
+				Expect(c.Get(ctx, key, &updated)).To(Succeed())
+				Expect(updated.Spec.Overrides).To(ContainElement("controller.scope.namespace=apps"))
+			})
+		})
+	})
+
+	Context("when the load balancer is internal", func() {
+		BeforeEach(func() {
+			ingress.Spec.LoadBalancer = &operatorsv1alpha1.NginxLoadBalancer{
+				Type:   operatorsv1alpha1.NginxLoadBalancerInternal,
+				Subnet: "ingress",
+			}
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.240.0.7"}}
+		})
+
+		It("should annotate the Service and release the public IP", func() {
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).NotTo(ContainElement(HavePrefix("controller.service.loadBalancerIP=")))
+			var values map[string]interface{}
+			Expect(yaml.Unmarshal([]byte(updated.Spec.Values), &values)).To(Succeed())
+			Expect(values).To(HaveKeyWithValue("controller", HaveKeyWithValue("service", HaveKeyWithValue("annotations", And(
+				HaveKeyWithValue(internalAnnotation, "true"),
+				HaveKeyWithValue(internalSubnetAnnotation, "ingress"),
+			)))))
+
+			var nginxIngress operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &nginxIngress)).To(Succeed())
+			Expect(nginxIngress.Status.IPAddress).To(Equal("10.240.0.7"))
+			Expect(nginxIngress.Status.FQDN).To(BeEmpty())
+			Expect(operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionPublicIPReady).Reason).To(Equal("InternalLoadBalancer"))
+			Expect(operatorsv1alpha1.IsConditionTrue(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionReady)).To(BeTrue())
+
+			reconcile()
+			var ip cloudv1alpha1.PublicIP
+			Expect(apierrs.IsNotFound(c.Get(ctx, key, &ip))).To(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("replaced by an internal load balancer")))
+		})
+
+		Context("with a static private address", func() {
+			BeforeEach(func() {
+				ingress.Spec.LoadBalancer.IPAddress = "10.240.0.42"
+			})
+
+			It("should pin the load balancer to it", func() {
+				reconcile()
+				var updated operatorsv1alpha1.HelmRelease
+				Expect(c.Get(ctx, key, &updated)).To(Succeed())
+				Expect(updated.Spec.Overrides).To(ContainElement("controller.service.loadBalancerIP=10.240.0.42"))
+
+				var nginxIngress operatorsv1alpha1.NginxIngress
+				Expect(c.Get(ctx, key, &nginxIngress)).To(Succeed())
+				Expect(nginxIngress.Status.IPAddress).To(Equal("10.240.0.42"))
+				Expect(operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionLoadBalancerReady).Reason).To(Equal("Provisioning"))
+			})
+		})
+	})
+
+	Context("when the load balancer references a PublicIP", func() {
+		BeforeEach(func() {
+			partner = &cloudv1alpha1.PublicIP{
+				ObjectMeta: metav1.ObjectMeta{Name: "partner-ip", Namespace: key.Namespace},
+				Spec: cloudv1alpha1.PublicIPSpec{
+					SubscriptionID:   "sub",
+					ResourceGroup:    "static-ips",
+					Location:         "westus2",
+					AllocationMethod: "static",
+					DomainNameLabel:  "partner",
+				},
+				Status: cloudv1alpha1.PublicIPStatus{ProvisioningState: "Succeeded", IPAddress: "20.0.0.5"},
+			}
+			ingress.Spec.LoadBalancer = &operatorsv1alpha1.NginxLoadBalancer{
+				PublicIPRef: &operatorsv1alpha1.PublicIPReference{Name: partner.Name},
+			}
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "20.0.0.5"}}
+		})
+
+		It("should use it in place of its own without owning it", func() {
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.service.loadBalancerIP=20.0.0.5"))
+			Expect(updated.Spec.Values).To(ContainSubstring(resourceGroupAnnotation + ": static-ips"))
+
+			var nginxIngress operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &nginxIngress)).To(Succeed())
+			Expect(nginxIngress.Status.IPAddress).To(Equal("20.0.0.5"))
+			Expect(nginxIngress.Status.FQDN).To(Equal("partner.westus2.cloudapp.azure.com"))
+			Expect(operatorsv1alpha1.IsConditionTrue(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionReady)).To(BeTrue())
+
+			reconcile()
+			var ip cloudv1alpha1.PublicIP
+			Expect(apierrs.IsNotFound(c.Get(ctx, key, &ip))).To(BeTrue(), "the PublicIP created before is released")
+			Expect(c.Get(ctx, types.NamespacedName{Namespace: key.Namespace, Name: partner.Name}, &ip)).To(Succeed())
+			Expect(ip.OwnerReferences).To(BeEmpty())
+		})
+
+		Context("which it created itself", func() {
+			BeforeEach(func() {
+				ingress.Spec.LoadBalancer.PublicIPRef.Name = key.Name
+			})
+
+			It("should disown it", func() {
+				reconcile()
+				var ip cloudv1alpha1.PublicIP
+				Expect(c.Get(ctx, key, &ip)).To(Succeed())
+				Expect(ip.OwnerReferences).To(BeEmpty())
+				Expect(recorder.Events).To(Receive(ContainSubstring("DisownedPublicIP")))
+
+				owned, err := r.ownedPublicIPs(ctx, ingress)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(owned).To(BeEmpty(), "teardown leaves it alone")
+			})
+		})
+
+		Context("which another NginxIngress controls", func() {
+			BeforeEach(func() {
+				other := &operatorsv1alpha1.NginxIngress{
+					ObjectMeta: metav1.ObjectMeta{Name: "partner", Namespace: key.Namespace, UID: "partner-uid"},
+				}
+				Expect(ctrl.SetControllerReference(other, partner, s)).To(Succeed())
+				release.Spec.Chart = "mirror/nginx-ingress"
+			})
+
+			It("should report the conflict without using it", func() {
+				reconcile()
+				var nginxIngress operatorsv1alpha1.NginxIngress
+				Expect(c.Get(ctx, key, &nginxIngress)).To(Succeed())
+				condition := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionPublicIPReady)
+				Expect(condition).NotTo(BeNil())
+				Expect(condition.Status).To(Equal(corev1.ConditionFalse))
+				Expect(condition.Reason).To(Equal("PublicIPInUse"))
+				Expect(condition.Message).To(ContainSubstring("NginxIngress partner"))
+				Expect(recorder.Events).To(Receive(ContainSubstring("PublicIPConflict")))
+
+				var unchanged operatorsv1alpha1.HelmRelease
+				Expect(c.Get(ctx, key, &unchanged)).To(Succeed())
+				Expect(unchanged.Spec.Chart).To(Equal("mirror/nginx-ingress"))
+				var ip cloudv1alpha1.PublicIP
+				Expect(c.Get(ctx, key, &ip)).To(Succeed(), "the PublicIP created before keeps serving")
+			})
+		})
+
+		Context("which does not exist yet", func() {
+			BeforeEach(func() {
+				ingress.Spec.LoadBalancer.PublicIPRef.Name = "reserved-ip"
+			})
+
+			It("should wait for it", func() {
+				reconcile()
+				var nginxIngress operatorsv1alpha1.NginxIngress
+				Expect(c.Get(ctx, key, &nginxIngress)).To(Succeed())
+				waiting := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionWaitingForPublicIP)
+				Expect(waiting).NotTo(BeNil())
+				Expect(waiting.Status).To(Equal(corev1.ConditionTrue))
+				Expect(waiting.Message).To(ContainSubstring("reserved-ip"))
+
+				var ip cloudv1alpha1.PublicIP
+				Expect(c.Get(ctx, key, &ip)).To(Succeed(), "the PublicIP created before keeps serving")
+			})
+		})
+
+		It("should map the PublicIP to the NginxIngresses referencing it", func() {
+			Expect(r.referencingPublicIP(handler.MapObject{Meta: partner, Object: partner})).To(ConsistOf(
+				ctrl.Request{NamespacedName: key},
+			))
+			Expect(r.referencingPublicIP(handler.MapObject{Meta: oldIP, Object: oldIP})).To(BeEmpty())
+		})
+	})
+
+	Context("when the load balancer references a public IP by resource ID", func() {
+		BeforeEach(func() {
+			ingress.Spec.LoadBalancer = &operatorsv1alpha1.NginxLoadBalancer{
+				PublicIPRef: &operatorsv1alpha1.PublicIPReference{
+					ResourceID: "/subscriptions/sub/resourceGroups/static-ips/providers/Microsoft.Network/publicIPAddresses/partner-ip",
+				},
+			}
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "20.0.0.5"}}
+		})
+
+		It("should name it to the cloud provider and report the address it is given", func() {
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).NotTo(ContainElement(HavePrefix("controller.service.loadBalancerIP=")))
+			Expect(updated.Spec.Values).To(ContainSubstring(publicIPNameAnnotation + ": partner-ip"))
+			Expect(updated.Spec.Values).To(ContainSubstring(resourceGroupAnnotation + ": static-ips"))
+
+			var nginxIngress operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &nginxIngress)).To(Succeed())
+			Expect(nginxIngress.Status.IPAddress).To(Equal("20.0.0.5"))
+			Expect(operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionPublicIPReady).Status).To(Equal(corev1.ConditionUnknown))
+			Expect(operatorsv1alpha1.IsConditionTrue(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionReady)).To(BeTrue())
+		})
+	})
+
+	Context("when the chart is customized", func() {
+		BeforeEach(func() {
+			ingress.Spec.Chart = "mirror/nginx-ingress"
+			ingress.Spec.Version = "1.6.0"
+			ingress.Spec.Values = &runtime.RawExtension{
+				Raw: []byte(`{"controller":{"replicaCount":3,"service":{"loadBalancerIP":"10.9.9.9"}}}`),
+			}
+		})
+
+		It("should pass the values under the overrides it manages", func() {
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Chart).To(Equal("mirror/nginx-ingress"))
+			Expect(updated.Spec.Version).To(Equal("1.6.0"))
+			Expect(updated.Spec.Values).To(Equal("controller:\n  replicaCount: 3\n  service:\n    loadBalancerIP: 10.9.9.9\n"))
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.service.loadBalancerIP=10.0.0.1"))
+
+			var ingress operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &ingress)).To(Succeed())
+			overridden := operatorsv1alpha1.FindCondition(ingress.Status.Conditions, operatorsv1alpha1.ConditionValuesOverridden)
+			Expect(overridden).NotTo(BeNil())
+			Expect(overridden.Status).To(Equal(corev1.ConditionTrue))
+			Expect(overridden.Message).To(ContainSubstring("controller.service.loadBalancerIP"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("ValuesOverridden")))
+		})
+	})
+
+	Context("when the controller is configured", func() {
+		BeforeEach(func() {
+			replicas := int32(2)
+			ingress.Spec.Values = &runtime.RawExtension{
+				Raw: []byte(`{"controller":{"replicaCount":3,"image":{"tag":"0.25.1"},"config":{"proxy-body-size":"1m"}}}`),
+			}
+			ingress.Spec.Controller = &operatorsv1alpha1.NginxController{
+				Replicas: &replicas,
+				Config: &operatorsv1alpha1.NginxConfig{
+					ProxyBodySize:    "8m",
+					ProxyReadTimeout: &metav1.Duration{Duration: 2 * time.Minute},
+				},
+				Metrics:   &operatorsv1alpha1.NginxMetrics{Enabled: true},
+				LogFormat: operatorsv1alpha1.NginxLogFormatJSON,
+			}
+		})
+
+		It("should translate the settings into chart values over spec.values", func() {
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			var values struct {
+				Controller struct {
+					ReplicaCount int               `json:"replicaCount"`
+					Image        map[string]string `json:"image"`
+					Config       map[string]string `json:"config"`
+					Metrics      struct {
+						Enabled bool `json:"enabled"`
+					} `json:"metrics"`
+				} `json:"controller"`
+			}
+			Expect(yaml.Unmarshal([]byte(updated.Spec.Values), &values)).To(Succeed())
+			Expect(values.Controller.ReplicaCount).To(Equal(2))
+			Expect(values.Controller.Image).To(HaveKeyWithValue("tag", "0.25.1"))
+			Expect(values.Controller.Config).To(HaveKeyWithValue("proxy-body-size", "8m"))
+			Expect(values.Controller.Config).To(HaveKeyWithValue("proxy-read-timeout", "120"))
+			Expect(values.Controller.Config).To(HaveKeyWithValue("log-format-escape-json", "true"))
+			Expect(values.Controller.Metrics.Enabled).To(BeTrue())
+		})
+	})
+
+	Context("when the public IP is not allocated", func() {
+		BeforeEach(func() {
+			oldIP.Status = cloudv1alpha1.PublicIPStatus{ProvisioningState: "Updating"}
+			release.Spec.Chart = "mirror/nginx-ingress"
+		})
+
+		waiting := func() *operatorsv1alpha1.Condition {
+			var ingress operatorsv1alpha1.NginxIngress
+			Expect(c.Get(ctx, key, &ingress)).To(Succeed())
+			return operatorsv1alpha1.FindCondition(ingress.Status.Conditions, operatorsv1alpha1.ConditionWaitingForPublicIP)
+		}
+
+		setIP := func(status cloudv1alpha1.PublicIPStatus) {
+			var ip cloudv1alpha1.PublicIP
+			Expect(c.Get(ctx, key, &ip)).To(Succeed())
+			ip.Status = status
+			Expect(c.Update(ctx, &ip)).To(Succeed())
+		}
+
+		It("should hold the release back until the address is known", func() {
+			reconcile()
+			Expect(waiting().Reason).To(Equal("Provisioning"))
+
+			setIP(cloudv1alpha1.PublicIPStatus{ProvisioningState: "Succeeded"})
+			reconcile()
+			Expect(string(waiting().Status)).To(Equal("True"))
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Chart).To(Equal("mirror/nginx-ingress"))
+
+			setIP(cloudv1alpha1.PublicIPStatus{ProvisioningState: "Succeeded", IPAddress: "10.0.0.3"})
+			reconcile()
+			Expect(string(waiting().Status)).To(Equal("False"))
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.service.loadBalancerIP=10.0.0.3"))
+		})
+
+		It("should report a failed allocation", func() {
+			setIP(cloudv1alpha1.PublicIPStatus{ProvisioningState: "Failed"})
+			reconcile()
+			Expect(waiting().Reason).To(Equal("ProvisioningFailed"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("ProvisioningFailed")))
+		})
+
+		It("should report an allocation which times out", func() {
+			cfg := config.Defaults()
+			cfg.Timeouts.PublicIPAllocation.Duration = time.Millisecond
+			r.Config = config.NewStore("", cfg)
+
+			reconcile()
+			Expect(waiting().Reason).To(Equal("Provisioning"))
+			time.Sleep(10 * time.Millisecond)
+			reconcile()
+			Expect(waiting().Reason).To(Equal("Timeout"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("was not allocated within 1ms")))
+		})
+	})
+
+	Context("when the location changes", func() {
+		BeforeEach(func() {
+			ingress.Spec.Location = "eastus"
+		})
+
+		It("should cut over to a new public IP before deleting the old one", func() {
+			reconcile()
+			newKey := types.NamespacedName{Namespace: key.Namespace, Name: publicIPName(ingress, []cloudv1alpha1.PublicIP{*oldIP})}
+			var newIP cloudv1alpha1.PublicIP
+			Expect(c.Get(ctx, newKey, &newIP)).To(Succeed())
+			Expect(newIP.Spec.Location).To(Equal("eastus"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("ReplacingPublicIP")))
+
+			// The release keeps the old address until the new one is allocated.
+			reconcile()
+			var updated operatorsv1alpha1.HelmRelease
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.service.loadBalancerIP=10.0.0.1"))
+
+			newIP.Status = cloudv1alpha1.PublicIPStatus{ProvisioningState: "Succeeded", IPAddress: "10.0.0.2"}
+			Expect(c.Update(ctx, &newIP)).To(Succeed())
+			reconcile()
+			Expect(c.Get(ctx, key, &updated)).To(Succeed())
+			Expect(updated.Spec.Overrides).To(ContainElement("controller.service.loadBalancerIP=10.0.0.2"))
+
+			// The load balancer still answers on the old address.
+			reconcile()
+			Expect(c.Get(ctx, key, &cloudv1alpha1.PublicIP{})).To(Succeed())
+
+			Expect(c.Get(ctx, types.NamespacedName{Namespace: key.Namespace, Name: service.Name}, service)).To(Succeed())
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.2"}}
+			Expect(c.Status().Update(ctx, service)).To(Succeed())
+			reconcile()
+			Expect(apierrs.IsNotFound(c.Get(ctx, key, &cloudv1alpha1.PublicIP{}))).To(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("ReplacedPublicIP")))
+		})
+	})
+})
@@ -0,0 +1,342 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cloudv1alpha1 "github.com/alexeldeib/cloud/api/v1alpha1"
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// desiredPublicIP returns the PublicIP nginxIngress should have, without a
+// name.
+func desiredPublicIP(nginxIngress *operatorsv1alpha1.NginxIngress) cloudv1alpha1.PublicIP {
+	publicIPPrefix := fmt.Sprintf("%s-%s-%s-ingress", nginxIngress.Spec.ResourceGroup, nginxIngress.Namespace, nginxIngress.Name)
+
+	return cloudv1alpha1.PublicIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: nginxIngress.Namespace,
+			Labels:    childLabels(nginxIngress),
+		},
+		Spec: cloudv1alpha1.PublicIPSpec{
+			SubscriptionID:   nginxIngress.Spec.SubscriptionID,
+			ResourceGroup:    nginxIngress.Spec.ResourceGroup,
+			Location:         nginxIngress.Spec.Location,
+			AllocationMethod: "static",
+			DomainNameLabel:  publicIPPrefix,
+		},
+	}
+}
+
+// reconcilePublicIP brings the PublicIPs owned by nginxIngress in line with
+// its spec. It returns the PublicIP matching the spec, or nil if one was just
+// created, and the owned PublicIPs it replaces.
+//
+// Fields Azure cannot change on an existing address are changed by creating a
+// second PublicIP. The one it replaces is kept, and keeps serving, until the
+// release has cut over to the new address; see finishCutOver.
+func (r *NginxIngressReconciler) reconcilePublicIP(ctx context.Context, log logr.Logger, nginxIngress *operatorsv1alpha1.NginxIngress) (*cloudv1alpha1.PublicIP, []cloudv1alpha1.PublicIP, error) {
+	desired := desiredPublicIP(nginxIngress)
+
+	owned, err := r.ownedPublicIPs(ctx, nginxIngress)
+	if err != nil {
+		return nil, nil, err
+	}
+	var current *cloudv1alpha1.PublicIP
+	var stale []cloudv1alpha1.PublicIP
+	for i := range owned {
+		if current == nil && owned[i].DeletionTimestamp.IsZero() && !shouldReplaceIP(owned[i], desired) {
+			current = &owned[i]
+			continue
+		}
+		stale = append(stale, owned[i])
+	}
+
+	if current == nil {
+		desired.Name = publicIPName(nginxIngress, owned)
+		if err := ctrl.SetControllerReference(nginxIngress, &desired, r.Scheme); err != nil {
+			log.Error(err, "unable to set controller owner reference for IP")
+			return nil, nil, err
+		}
+		if err := r.Create(ctx, &desired); err != nil {
+			log.Error(err, "unable to create publicIP for nginxRelease", "IP", desired.Name)
+			return nil, nil, err
+		}
+		if len(stale) > 0 {
+			r.Recorder.Eventf(nginxIngress, "Normal", "ReplacingPublicIP",
+				"Created PublicIP %s to replace %s, as its subscription, resource group or location changed", desired.Name, publicIPNames(stale))
+		}
+		return nil, stale, nil
+	}
+
+	if shouldUpdateIP(*current, desired) {
+		current.Labels = desired.Labels
+		current.Spec.AllocationMethod = desired.Spec.AllocationMethod
+		current.Spec.DomainNameLabel = desired.Spec.DomainNameLabel
+		if err := r.Update(ctx, current); err != nil {
+			log.Error(err, "unable to update publicIP for nginxRelease", "IP", current.Name)
+			return nil, nil, err
+		}
+		log.Info("public IP updated without errors", "IP", current.Name)
+	}
+	return current, stale, nil
+}
+
+// referencedPublicIP returns the PublicIP named name which nginxIngress
+// references, or nil if it does not exist yet, and the owned PublicIPs it
+// replaces. Were it created by nginxIngress, it is disowned, so that it is
+// neither garbage collected nor torn down with nginxIngress.
+func (r *NginxIngressReconciler) referencedPublicIP(ctx context.Context, log logr.Logger, nginxIngress *operatorsv1alpha1.NginxIngress, name string) (*cloudv1alpha1.PublicIP, []cloudv1alpha1.PublicIP, error) {
+	owned, err := r.ownedPublicIPs(ctx, nginxIngress)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stale []cloudv1alpha1.PublicIP
+	for _, ip := range owned {
+		if ip.Name != name {
+			stale = append(stale, ip)
+		}
+	}
+
+	var ip cloudv1alpha1.PublicIP
+	if err := r.Get(ctx, types.NamespacedName{Namespace: nginxIngress.Namespace, Name: name}, &ip); err != nil {
+		if apierrs.IsNotFound(err) {
+			log.Info("waiting for referenced public IP to be created", "IP", name)
+			return nil, stale, nil
+		}
+		return nil, nil, err
+	}
+
+	if metav1.IsControlledBy(&ip, nginxIngress) {
+		var refs []metav1.OwnerReference
+		for _, ref := range ip.OwnerReferences {
+			if ref.UID != nginxIngress.UID {
+				refs = append(refs, ref)
+			}
+		}
+		ip.OwnerReferences = refs
+		if err := r.Update(ctx, &ip); err != nil {
+			log.Error(err, "unable to disown referenced publicIP", "IP", name)
+			return nil, nil, err
+		}
+		r.Recorder.Eventf(nginxIngress, "Normal", "DisownedPublicIP",
+			"PublicIP %s is referenced by publicIPRef, and is no longer deleted with the NginxIngress", name)
+	}
+	return &ip, stale, nil
+}
+
+// publicIPController returns the controller of publicIP, or nil if it has
+// none or publicIP is nil.
+func publicIPController(publicIP *cloudv1alpha1.PublicIP) *metav1.OwnerReference {
+	if publicIP == nil {
+		return nil
+	}
+	return metav1.GetControllerOf(publicIP)
+}
+
+// refusePublicIP reports that nginxIngress references publicIP, which owner
+// controls, and leaves its children alone until the reference or the owner
+// changes.
+func (r *NginxIngressReconciler) refusePublicIP(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress, publicIP *cloudv1alpha1.PublicIP, owner *metav1.OwnerReference) error {
+	message := fmt.Sprintf("PublicIP %s is controlled by %s %s", publicIP.Name, owner.Kind, owner.Name)
+	current := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionPublicIPReady)
+	if current != nil && current.Status == corev1.ConditionFalse && current.Message == message {
+		return nil
+	}
+	nginxIngress.Status.PublicIPReady = false
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionPublicIPReady,
+		Status:  corev1.ConditionFalse,
+		Reason:  "PublicIPInUse",
+		Message: message,
+	})
+	r.Recorder.Event(nginxIngress, "Warning", "PublicIPConflict", message)
+	if err := r.Status().Update(ctx, nginxIngress); err != nil {
+		r.Log.Error(err, "unable to update NginxIngress status")
+		return err
+	}
+	return nil
+}
+
+// referencingPublicIP maps a PublicIP to the NginxIngresses referencing it,
+// which do not own it and so are not reconciled on its changes otherwise.
+func (r *NginxIngressReconciler) referencingPublicIP(obj handler.MapObject) []reconcile.Request {
+	var list operatorsv1alpha1.NginxIngressList
+	if err := r.List(context.Background(), &list, client.InNamespace(obj.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list NginxIngresses referencing a public IP")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, nginxIngress := range list.Items {
+		if ref := nginxIngress.GetPublicIPRef(); ref != nil && ref.Name == obj.Meta.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: nginxIngress.Namespace, Name: nginxIngress.Name},
+			})
+		}
+	}
+	return requests
+}
+
+// waitForPublicIP sets the WaitingForPublicIP condition of nginxIngress, and
+// returns how long until the wait for publicIP, which may be nil, times out.
+// A failed or timed out allocation is reported by a warning event once.
+func (r *NginxIngressReconciler) waitForPublicIP(nginxIngress *operatorsv1alpha1.NginxIngress, publicIP *cloudv1alpha1.PublicIP, allocated bool, timeout time.Duration) time.Duration {
+	conditions := &nginxIngress.Status.Conditions
+	if allocated {
+		operatorsv1alpha1.SetCondition(conditions, operatorsv1alpha1.Condition{
+			Type:   operatorsv1alpha1.ConditionWaitingForPublicIP,
+			Status: corev1.ConditionFalse,
+			Reason: "Allocated",
+		})
+		return 0
+	}
+
+	name := nginxIngress.Name
+	if ref := nginxIngress.GetPublicIPRef(); ref != nil {
+		name = ref.Name
+	}
+	if publicIP != nil {
+		name = publicIP.Name
+	}
+	var elapsed time.Duration
+	waiting := operatorsv1alpha1.FindCondition(*conditions, operatorsv1alpha1.ConditionWaitingForPublicIP)
+	if waiting != nil && waiting.Status == corev1.ConditionTrue {
+		elapsed = time.Since(waiting.LastTransitionTime.Time)
+	}
+
+	reason, message, remaining := "Provisioning", fmt.Sprintf("Waiting for PublicIP %s to be allocated", name), timeout-elapsed
+	switch {
+	case publicIP != nil && publicIP.Status.ProvisioningState == "Failed":
+		reason, message, remaining = "ProvisioningFailed", fmt.Sprintf("PublicIP %s failed to provision", name), 0
+	case remaining <= 0:
+		reason, message, remaining = "Timeout", fmt.Sprintf("PublicIP %s was not allocated within %s", name, timeout), 0
+	}
+	if reason != "Provisioning" && (waiting == nil || waiting.Reason != reason) {
+		r.Recorder.Event(nginxIngress, "Warning", reason, message)
+	}
+	operatorsv1alpha1.SetCondition(conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionWaitingForPublicIP,
+		Status:  corev1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+	return remaining
+}
+
+// finishCutOver deletes the stale PublicIPs of nginxIngress once release has
+// been deployed with their replacement, described by replacement, and no load
+// balancer of the release still uses a stale address. It reports whether they
+// were deleted.
+func (r *NginxIngressReconciler) finishCutOver(ctx context.Context, log logr.Logger, nginxIngress *operatorsv1alpha1.NginxIngress, release *operatorsv1alpha1.HelmRelease, replacement string, stale []cloudv1alpha1.PublicIP) (bool, error) {
+	if release.Status.ProvisioningState != operatorsv1alpha1.ProvisioningStateSucceeded ||
+		release.Status.ObservedGeneration != release.Generation {
+		log.Info("waiting for release to deploy the replacement of the public IP", "replacement", replacement)
+		return false, nil
+	}
+
+	staleAddresses := map[string]bool{}
+	for _, ip := range stale {
+		if ip.Status.IPAddress != "" {
+			staleAddresses[ip.Status.IPAddress] = true
+		}
+	}
+	balancers, err := r.loadBalancers(ctx, nginxIngress)
+	if err != nil {
+		return false, err
+	}
+	for _, service := range balancers {
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if staleAddresses[ingress.IP] {
+				log.Info("waiting for load balancer to release the replaced public IP", "service", service.Name, "address", ingress.IP)
+				return false, nil
+			}
+		}
+	}
+
+	for i := range stale {
+		if !stale[i].DeletionTimestamp.IsZero() {
+			continue
+		}
+		if err := r.Delete(ctx, &stale[i]); ignoreNotFound(err) != nil {
+			log.Error(err, "unable to delete replaced publicIP", "IP", stale[i].Name)
+			return false, err
+		}
+		r.Recorder.Eventf(nginxIngress, "Normal", "ReplacedPublicIP",
+			"Deleted PublicIP %s, replaced by %s", stale[i].Name, replacement)
+	}
+	return true, nil
+}
+
+// ownedPublicIPs returns the PublicIPs controlled by nginxIngress.
+func (r *NginxIngressReconciler) ownedPublicIPs(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress) ([]cloudv1alpha1.PublicIP, error) {
+	var list cloudv1alpha1.PublicIPList
+	if err := r.List(ctx, &list, client.InNamespace(nginxIngress.Namespace)); err != nil {
+		return nil, err
+	}
+	var owned []cloudv1alpha1.PublicIP
+	for _, ip := range list.Items {
+		if metav1.IsControlledBy(&ip, nginxIngress) {
+			owned = append(owned, ip)
+		}
+	}
+	return owned, nil
+}
+
+// publicIPName returns the name for a new PublicIP of nginxIngress. The first
+// one is named after nginxIngress; replacements add a hash of the fields which
+// forced the replacement.
+func publicIPName(nginxIngress *operatorsv1alpha1.NginxIngress, owned []cloudv1alpha1.PublicIP) string {
+	taken := false
+	for _, ip := range owned {
+		if ip.Name == nginxIngress.Name {
+			taken = true
+		}
+	}
+	if !taken {
+		return nginxIngress.Name
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%s/%s", nginxIngress.Spec.SubscriptionID, nginxIngress.Spec.ResourceGroup, nginxIngress.Spec.Location)
+	return fmt.Sprintf("%s-%08x", nginxIngress.Name, h.Sum32())
+}
+
+// publicIPNames returns the names of ips.
+func publicIPNames(ips []cloudv1alpha1.PublicIP) []string {
+	names := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		names = append(names, ip.Name)
+	}
+	return names
+}
+
+// publicIPReady reports whether ip has been allocated.
+func publicIPReady(ip *cloudv1alpha1.PublicIP) bool {
+	return ip != nil && ip.Status.ProvisioningState == "Succeeded"
+}
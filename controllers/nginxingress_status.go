@@ -0,0 +1,101 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	cloudv1alpha1 "github.com/alexeldeib/cloud/api/v1alpha1"
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// loadBalancerCondition returns the LoadBalancerReady condition of a release
+// whose load balancer Services should answer on address. If assigned, the
+// address is assigned by Azure and unknown until the Service reports it.
+func loadBalancerCondition(balancers []corev1.Service, address string, assigned bool) operatorsv1alpha1.Condition {
+	condition := operatorsv1alpha1.Condition{
+		Type:   operatorsv1alpha1.ConditionLoadBalancerReady,
+		Status: corev1.ConditionFalse,
+	}
+	switch {
+	case address == "" && !assigned:
+		condition.Reason = "WaitingForPublicIP"
+	case len(balancers) == 0:
+		condition.Reason = "ServiceNotFound"
+		condition.Message = "The nginx release has no load balancer Service"
+	default:
+		for _, service := range balancers {
+			for _, ingress := range service.Status.LoadBalancer.Ingress {
+				if ingress.IP == address {
+					condition.Status = corev1.ConditionTrue
+					condition.Reason = "Provisioned"
+					condition.Message = ""
+					return condition
+				}
+			}
+			condition.Reason = "Provisioning"
+			condition.Message = fmt.Sprintf("Waiting for Service %s to be exposed on %s", service.Name, address)
+			if address == "" {
+				condition.Message = fmt.Sprintf("Waiting for Service %s to be given an address", service.Name)
+			}
+		}
+	}
+	return condition
+}
+
+// publicIPFQDN returns the DNS name Azure gives to ip through its domain name
+// label, or the empty string if it has none.
+func publicIPFQDN(ip *cloudv1alpha1.PublicIP) string {
+	if ip == nil || ip.Spec.DomainNameLabel == "" {
+		return ""
+	}
+	location := strings.ToLower(strings.Replace(ip.Spec.Location, " ", "", -1))
+	return fmt.Sprintf("%s.%s.cloudapp.azure.com", ip.Spec.DomainNameLabel, location)
+}
+
+// balancerAddress returns the address Azure gave to the first of balancers
+// to have one, or the empty string.
+func balancerAddress(balancers []corev1.Service) string {
+	for _, service := range balancers {
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				return ingress.IP
+			}
+		}
+	}
+	return ""
+}
+
+// setPublicIPUnobserved sets the public IP conditions of an NginxIngress
+// without a PublicIP object to wait for: PublicIPReady to status, and
+// WaitingForPublicIP to false.
+func setPublicIPUnobserved(conditions *[]operatorsv1alpha1.Condition, status corev1.ConditionStatus, reason, message string) {
+	operatorsv1alpha1.SetCondition(conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionPublicIPReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	operatorsv1alpha1.SetCondition(conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionWaitingForPublicIP,
+		Status:  corev1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+}
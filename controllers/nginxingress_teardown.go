@@ -0,0 +1,193 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// nginxIngressFinalizer holds an NginxIngress until its children are torn
+// down in order.
+const nginxIngressFinalizer = "nginxingress.operators.alexeldeib.xyz"
+
+// Labels naming the helm release an object belongs to. Charts following the
+// Kubernetes recommended labels, e.g. ingress-nginx, set instanceLabel; older
+// ones such as stable/nginx-ingress set releaseLabel.
+const (
+	instanceLabel = "app.kubernetes.io/instance"
+	releaseLabel  = "release"
+)
+
+// Reasons of the Terminating condition, one per teardown step.
+const (
+	reasonDeletingRelease        = "DeletingRelease"
+	reasonWaitingForLoadBalancer = "WaitingForLoadBalancer"
+	reasonDeletingPublicIP       = "DeletingPublicIP"
+)
+
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+
+// teardown removes the children of a deleted nginxIngress one step at a time:
+// the HelmRelease, then the load balancer Services of its release, then its
+// PublicIPs. Azure refuses to delete a public IP still used by a load balancer,
+// so the address is only released once nothing points at it. The finalizer is
+// removed when all children are gone. Children are watched; the Services are
+// not, and are polled for.
+func (r *NginxIngressReconciler) teardown(ctx context.Context, log logr.Logger, nginxIngress *operatorsv1alpha1.NginxIngress) (ctrl.Result, error) {
+	if !containsString(nginxIngress.Finalizers, nginxIngressFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	cfg := r.Config.Get()
+	key := types.NamespacedName{Namespace: nginxIngress.Namespace, Name: nginxIngress.Name}
+
+	var release operatorsv1alpha1.HelmRelease
+	gone, err := r.deleteChild(ctx, nginxIngress, key, &release)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !gone {
+		log.Info("waiting for helm release to be deleted")
+		return ctrl.Result{}, r.setTeardownStep(ctx, nginxIngress, reasonDeletingRelease,
+			fmt.Sprintf("Waiting for HelmRelease %s to be deleted", key.Name))
+	}
+
+	balancers, err := r.loadBalancers(ctx, nginxIngress)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(balancers) > 0 {
+		names := make([]string, 0, len(balancers))
+		for _, service := range balancers {
+			names = append(names, service.Name)
+		}
+		log.Info("waiting for load balancer services to be deleted", "services", names)
+		return ctrl.Result{RequeueAfter: cfg.Resync.LoadBalancerPoll.Duration}, r.setTeardownStep(ctx, nginxIngress, reasonWaitingForLoadBalancer,
+			fmt.Sprintf("Waiting for load balancer Services %v to be deleted", names))
+	}
+
+	publicIPs, err := r.ownedPublicIPs(ctx, nginxIngress)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(publicIPs) > 0 {
+		for i := range publicIPs {
+			if !publicIPs[i].DeletionTimestamp.IsZero() {
+				continue
+			}
+			if err := r.Delete(ctx, &publicIPs[i]); ignoreNotFound(err) != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		log.Info("waiting for public IPs to be deleted")
+		return ctrl.Result{}, r.setTeardownStep(ctx, nginxIngress, reasonDeletingPublicIP,
+			fmt.Sprintf("Waiting for PublicIPs %v to be deleted", publicIPNames(publicIPs)))
+	}
+
+	nginxIngress.Finalizers = removeString(nginxIngress.Finalizers, nginxIngressFinalizer)
+	if err := r.Update(ctx, nginxIngress); err != nil {
+		log.Error(err, "unable to remove finalizer")
+		return ctrl.Result{}, err
+	}
+	log.Info("successfully tore down nginx ingress")
+	return ctrl.Result{}, nil
+}
+
+// childObject is an object created for an NginxIngress.
+type childObject interface {
+	runtime.Object
+	metav1.Object
+}
+
+// deleteChild deletes the object with the given key, unless it is already
+// being deleted, and reports whether it is gone. An object nginxIngress does
+// not control is left alone and reported as gone, with an event.
+func (r *NginxIngressReconciler) deleteChild(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress, key types.NamespacedName, obj childObject) (bool, error) {
+	if err := r.Get(ctx, key, obj); err != nil {
+		if apierrs.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if !metav1.IsControlledBy(obj, nginxIngress) {
+		r.Log.Info("leaving child which is not controlled by this NginxIngress", "nginxingress", objectKey(nginxIngress), "child", key)
+		r.Recorder.Event(nginxIngress, "Normal", "Retained",
+			fmt.Sprintf("Leaving %s in place as it is not controlled by this NginxIngress", key.Name))
+		return true, nil
+	}
+	if !obj.GetDeletionTimestamp().IsZero() {
+		return false, nil
+	}
+	if err := r.Delete(ctx, obj); err != nil && !apierrs.IsNotFound(err) {
+		return false, err
+	}
+	// Children without finalizers of their own are gone at once; report them
+	// on the next pass.
+	return false, nil
+}
+
+// loadBalancers returns the LoadBalancer Services of the nginx release of
+// nginxIngress, found by either of the labels charts use to name their
+// release. The cloud provider holds each one until its load balancer rule is
+// removed.
+func (r *NginxIngressReconciler) loadBalancers(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress) ([]corev1.Service, error) {
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services, client.InNamespace(nginxIngress.Namespace)); err != nil {
+		return nil, err
+	}
+	var balancers []corev1.Service
+	for _, service := range services.Items {
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if service.Labels[instanceLabel] == nginxIngress.Name || service.Labels[releaseLabel] == nginxIngress.Name {
+			balancers = append(balancers, service)
+		}
+	}
+	return balancers, nil
+}
+
+// setTeardownStep records the teardown step nginxIngress is waiting on in its
+// Terminating condition. An event is emitted when the step changes.
+func (r *NginxIngressReconciler) setTeardownStep(ctx context.Context, nginxIngress *operatorsv1alpha1.NginxIngress, reason, message string) error {
+	current := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionTerminating)
+	if current != nil && current.Reason == reason && current.Message == message {
+		return nil
+	}
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, operatorsv1alpha1.Condition{
+		Type:    operatorsv1alpha1.ConditionTerminating,
+		Status:  corev1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+	r.Recorder.Event(nginxIngress, "Normal", reason, message)
+	if err := r.Status().Update(ctx, nginxIngress); err != nil {
+		r.Log.Error(err, "unable to update NginxIngress status")
+		return err
+	}
+	return nil
+}
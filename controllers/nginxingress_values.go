@@ -0,0 +1,330 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	cloudv1alpha1 "github.com/alexeldeib/cloud/api/v1alpha1"
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// publicIPOverride templates the static IP into the load balancer Service.
+var publicIPOverride = template.Must(template.New("ipoverride").Parse("controller.service.loadBalancerIP={{ .PublicIP }}"))
+
+// Annotations of the load balancer Service read by the Azure cloud provider.
+const (
+	internalAnnotation       = "service.beta.kubernetes.io/azure-load-balancer-internal"
+	internalSubnetAnnotation = "service.beta.kubernetes.io/azure-load-balancer-internal-subnet"
+	resourceGroupAnnotation  = "service.beta.kubernetes.io/azure-load-balancer-resource-group"
+	publicIPNameAnnotation   = "service.beta.kubernetes.io/azure-pip-name"
+)
+
+// managedOverrides returns the chart values the operator sets for the nginx
+// release of nginxIngress, whose load balancer is pinned to loadBalancerIP if
+// it is set, in helm's --set syntax. They are applied after spec.values, so
+// they win.
+func managedOverrides(nginxIngress *operatorsv1alpha1.NginxIngress, loadBalancerIP string) ([]string, error) {
+	var overrides []string
+	if loadBalancerIP != "" {
+		var override bytes.Buffer
+		params := map[string]string{
+			"PublicIP": loadBalancerIP,
+		}
+		if err := publicIPOverride.Execute(&override, params); err != nil {
+			return nil, errors.Wrap(err, "failed templating public IP override")
+		}
+		overrides = append(overrides, override.String())
+	}
+	class := nginxIngress.GetIngressClass()
+	overrides = append(overrides,
+		// Each class elects its own leader, which alone updates the status
+		// of the Ingresses of the class.
+		"controller.ingressClass="+class,
+		"controller.electionID=ingress-controller-leader-"+class,
+	)
+	if scope := nginxIngress.Spec.Scope; scope != nil {
+		namespace := scope.Namespace
+		if namespace == "" {
+			namespace = nginxIngress.Namespace
+		}
+		overrides = append(overrides,
+			"controller.scope.enabled=true",
+			"controller.scope.namespace="+namespace,
+		)
+	}
+	return overrides, nil
+}
+
+// managedAnnotations returns the annotations the operator sets on the load
+// balancer Service of nginxIngress, whose public IP, if it has an object, is
+// publicIP. They are strings, which --set would turn into booleans, so they
+// are merged into the values file last instead.
+func managedAnnotations(nginxIngress *operatorsv1alpha1.NginxIngress, publicIP *cloudv1alpha1.PublicIP) map[string]string {
+	if nginxIngress.IsInternal() {
+		annotations := map[string]string{internalAnnotation: "true"}
+		if subnet := nginxIngress.Spec.LoadBalancer.Subnet; subnet != "" {
+			annotations[internalSubnetAnnotation] = subnet
+		}
+		return annotations
+	}
+	// A referenced public IP may live outside the resource group the cloud
+	// provider looks in by default.
+	ref := nginxIngress.GetPublicIPRef()
+	switch {
+	case ref == nil:
+		return nil
+	case ref.ResourceID != "":
+		_, group, name, _ := operatorsv1alpha1.ParsePublicIPResourceID(ref.ResourceID)
+		return map[string]string{resourceGroupAnnotation: group, publicIPNameAnnotation: name}
+	case publicIP != nil:
+		return map[string]string{resourceGroupAnnotation: publicIP.Spec.ResourceGroup}
+	}
+	return nil
+}
+
+// nginxIngressValues returns the values file for nginxIngress: spec.values,
+// with the settings of spec.controller and the load balancer annotations
+// merged over them. It also returns the paths of the overrides and annotations which
+// replace a value set by spec.values or spec.controller.
+func nginxIngressValues(nginxIngress *operatorsv1alpha1.NginxIngress, overrides []string, annotations map[string]string) (string, []string, error) {
+	var docs []string
+	if raw := nginxIngress.Spec.Values; raw != nil && len(raw.Raw) > 0 {
+		var values map[string]interface{}
+		if err := json.Unmarshal(raw.Raw, &values); err != nil {
+			return "", nil, errors.Wrap(err, "spec.values is not an object")
+		}
+		doc, err := yaml.JSONToYAML(raw.Raw)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to render spec.values")
+		}
+		docs = append(docs, string(doc))
+	}
+	if settings := controllerValues(nginxIngress.Spec.Controller); settings != nil {
+		doc, err := yaml.Marshal(settings)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to render spec.controller")
+		}
+		docs = append(docs, string(doc))
+	}
+	merged, err := helm.MergeValues(docs...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(merged, &values); err != nil {
+		return "", nil, errors.Wrap(err, "failed to parse merged values")
+	}
+	var overridden []string
+	for _, override := range overrides {
+		if setsValue(values, valuePath(override)) {
+			overridden = append(overridden, strings.SplitN(override, "=", 2)[0])
+		}
+	}
+
+	if len(annotations) == 0 {
+		return string(merged), overridden, nil
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if setsValue(values, []string{"controller", "service", "annotations", key}) {
+			overridden = append(overridden, "controller.service.annotations."+strings.Replace(key, ".", `\.`, -1))
+		}
+	}
+	doc, err := yaml.Marshal(map[string]interface{}{
+		"controller": map[string]interface{}{
+			"service": map[string]interface{}{"annotations": annotations},
+		},
+	})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to render load balancer annotations")
+	}
+	if merged, err = helm.MergeValues(string(merged), string(doc)); err != nil {
+		return "", nil, err
+	}
+	return string(merged), overridden, nil
+}
+
+// jsonLogFormat is the access log format of LogFormat JSON. Variables which
+// may be empty or "-" are quoted.
+const jsonLogFormat = `{"time": "$time_iso8601", "remote_addr": "$remote_addr", "request_id": "$req_id", ` +
+	`"method": "$request_method", "host": "$host", "path": "$uri", "protocol": "$server_protocol", ` +
+	`"status": $status, "bytes_sent": $bytes_sent, "request_time": $request_time, ` +
+	`"upstream_addr": "$upstream_addr", "upstream_status": "$upstream_status", ` +
+	`"upstream_response_time": "$upstream_response_time", "user_agent": "$http_user_agent"}`
+
+// controllerValues translates settings into values of the nginx-ingress
+// chart, or returns nil if there are none.
+func controllerValues(settings *operatorsv1alpha1.NginxController) map[string]interface{} {
+	if settings == nil {
+		return nil
+	}
+	controller := map[string]interface{}{}
+	if settings.Replicas != nil {
+		controller["replicaCount"] = *settings.Replicas
+	}
+	if settings.Resources != nil {
+		controller["resources"] = settings.Resources
+	}
+	if a := settings.Autoscaling; a != nil {
+		autoscaling := map[string]interface{}{
+			"enabled":     true,
+			"minReplicas": a.MinReplicas,
+			"maxReplicas": a.MaxReplicas,
+		}
+		if a.TargetCPUUtilizationPercentage != nil {
+			autoscaling["targetCPUUtilizationPercentage"] = *a.TargetCPUUtilizationPercentage
+		}
+		controller["autoscaling"] = autoscaling
+	}
+	if settings.MinAvailable != nil {
+		controller["minAvailable"] = settings.MinAvailable
+	}
+	if len(settings.NodeSelector) > 0 {
+		controller["nodeSelector"] = settings.NodeSelector
+	}
+	if len(settings.Tolerations) > 0 {
+		controller["tolerations"] = settings.Tolerations
+	}
+	if settings.Affinity != nil {
+		controller["affinity"] = settings.Affinity
+	}
+	if config := nginxConfig(settings); len(config) > 0 {
+		controller["config"] = config
+	}
+	if m := settings.Metrics; m != nil {
+		controller["metrics"] = map[string]interface{}{
+			"enabled":        m.Enabled,
+			"serviceMonitor": map[string]interface{}{"enabled": m.ServiceMonitor},
+		}
+	}
+	if len(controller) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"controller": controller}
+}
+
+// nginxConfig returns the entries of the controller ConfigMap set by
+// settings. ConfigMap values are strings.
+func nginxConfig(settings *operatorsv1alpha1.NginxController) map[string]string {
+	config := map[string]string{}
+	if c := settings.Config; c != nil {
+		if c.ProxyBodySize != "" {
+			config["proxy-body-size"] = c.ProxyBodySize
+		}
+		setSeconds(config, "proxy-connect-timeout", c.ProxyConnectTimeout)
+		setSeconds(config, "proxy-read-timeout", c.ProxyReadTimeout)
+		setSeconds(config, "proxy-send-timeout", c.ProxySendTimeout)
+		if len(c.SSLProtocols) > 0 {
+			config["ssl-protocols"] = strings.Join(c.SSLProtocols, " ")
+		}
+		if c.UseForwardedHeaders != nil {
+			config["use-forwarded-headers"] = strconv.FormatBool(*c.UseForwardedHeaders)
+		}
+	}
+	if settings.LogFormat == operatorsv1alpha1.NginxLogFormatJSON {
+		config["log-format-escape-json"] = "true"
+		config["log-format-upstream"] = jsonLogFormat
+	}
+	return config
+}
+
+// setSeconds sets key in config to timeout in seconds, if it is set.
+func setSeconds(config map[string]string, key string, timeout *metav1.Duration) {
+	if timeout != nil {
+		config[key] = strconv.FormatInt(int64(timeout.Duration/time.Second), 10)
+	}
+}
+
+// valuePath splits the path of a --set override into keys. As in helm, a dot
+// escaped by a backslash belongs to the key.
+func valuePath(override string) []string {
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(override); i++ {
+		switch c := override[i]; {
+		case c == '\\' && i+1 < len(override):
+			i++
+			key.WriteByte(override[i])
+		case c == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		case c == '=':
+			return append(keys, key.String())
+		default:
+			key.WriteByte(c)
+		}
+	}
+	return append(keys, key.String())
+}
+
+// setsValue reports whether values sets the value at path, or a value other
+// than a map on the way to it.
+func setsValue(values map[string]interface{}, path []string) bool {
+	for i, key := range path {
+		value, ok := values[key]
+		if !ok {
+			return false
+		}
+		if i == len(path)-1 {
+			return true
+		}
+		if values, ok = value.(map[string]interface{}); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reportOverriddenValues sets the ValuesOverridden condition of nginxIngress
+// from the paths of spec.values replaced by the operator. A warning event is
+// emitted when they change.
+func (r *NginxIngressReconciler) reportOverriddenValues(nginxIngress *operatorsv1alpha1.NginxIngress, overridden []string) {
+	condition := operatorsv1alpha1.Condition{
+		Type:   operatorsv1alpha1.ConditionValuesOverridden,
+		Status: corev1.ConditionFalse,
+		Reason: "NoConflicts",
+	}
+	if len(overridden) > 0 {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "ManagedByOperator"
+		condition.Message = fmt.Sprintf("spec.values sets %s, which the operator manages; the operator's values are used",
+			strings.Join(overridden, ", "))
+		current := operatorsv1alpha1.FindCondition(nginxIngress.Status.Conditions, operatorsv1alpha1.ConditionValuesOverridden)
+		if current == nil || current.Message != condition.Message {
+			r.Recorder.Event(nginxIngress, "Warning", "ValuesOverridden", condition.Message)
+		}
+	}
+	operatorsv1alpha1.SetCondition(&nginxIngress.Status.Conditions, condition)
+}
@@ -0,0 +1,80 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Scope is the set of objects one manager instance is responsible for, so
+// that several instances, e.g. one per team, can share a cluster. The zero
+// value covers everything.
+type Scope struct {
+	// Namespaces, if any, are the only namespaces watched. Cluster-scoped
+	// objects are out of scope when set.
+	Namespaces []string
+	// Selector, if set, must match the labels of an object.
+	Selector labels.Selector
+}
+
+// Restricted reports whether s covers less than everything.
+func (s Scope) Restricted() bool {
+	return len(s.Namespaces) > 0 || (s.Selector != nil && !s.Selector.Empty())
+}
+
+// ContainsNamespace reports whether objects in namespace may be in s. The
+// empty namespace stands for cluster-scoped objects.
+func (s Scope) ContainsNamespace(namespace string) bool {
+	if len(s.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range s.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether obj is in s.
+func (s Scope) Contains(obj metav1.Object) bool {
+	if !s.ContainsNamespace(obj.GetNamespace()) {
+		return false
+	}
+	return s.Selector == nil || s.Selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// Predicate drops events for objects outside s. The cache already limits
+// namespaces; the selector is only applied here.
+func (s Scope) Predicate() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return s.Contains(e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return s.Contains(e.MetaNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return s.Contains(e.Meta)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return s.Contains(e.Meta)
+		},
+	}
+}
@@ -0,0 +1,57 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+var _ = Describe("Scope", func() {
+	release := func(namespace string, lbls map[string]string) *operatorsv1alpha1.HelmRelease {
+		return &operatorsv1alpha1.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: namespace, Labels: lbls}}
+	}
+
+	It("should contain everything when unrestricted", func() {
+		scope := Scope{}
+		Expect(scope.Restricted()).To(BeFalse())
+		Expect(scope.Contains(release("default", nil))).To(BeTrue())
+		Expect(scope.Contains(&operatorsv1alpha1.ClusterHelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "nginx"}})).To(BeTrue())
+	})
+
+	It("should contain only the listed namespaces", func() {
+		scope := Scope{Namespaces: []string{"team-a", "team-b"}}
+		Expect(scope.Restricted()).To(BeTrue())
+		Expect(scope.Contains(release("team-b", nil))).To(BeTrue())
+		Expect(scope.Contains(release("default", nil))).To(BeFalse())
+		Expect(scope.Contains(&operatorsv1alpha1.ClusterHelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "nginx"}})).To(BeFalse())
+	})
+
+	It("should contain only objects matching the selector", func() {
+		selector, err := labels.Parse("team=a")
+		Expect(err).NotTo(HaveOccurred())
+		scope := Scope{Selector: selector}
+		Expect(scope.Restricted()).To(BeTrue())
+		Expect(scope.Contains(release("default", map[string]string{"team": "a"}))).To(BeTrue())
+		Expect(scope.Contains(release("default", map[string]string{"team": "b"}))).To(BeFalse())
+		Expect(scope.Contains(release("default", nil))).To(BeFalse())
+	})
+})
@@ -0,0 +1,73 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"hash/fnv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// Shard is the share of objects reconciled by one manager replica. Objects
+// are assigned by hashing their ShardLabel, or when unlabelled the key of
+// their controller, so children land with their owner, or else their own key.
+// The zero value owns everything.
+type Shard struct {
+	// Index of this shard, from 0 to Count-1.
+	Index int
+	// Count is the number of shards. One or less disables sharding.
+	Count int
+}
+
+// Owns reports whether obj belongs to s.
+func (s Shard) Owns(obj metav1.Object) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	key := obj.GetLabels()[operatorsv1alpha1.ShardLabel]
+	if key == "" {
+		key = objectKey(obj)
+		if owner := metav1.GetControllerOf(obj); owner != nil && obj.GetNamespace() != "" {
+			key = obj.GetNamespace() + "/" + owner.Name
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index
+}
+
+// Predicate drops events for objects outside s. An object whose label moves
+// it to another shard is dropped here and picked up there.
+func (s Shard) Predicate() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return s.Owns(e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return s.Owns(e.MetaNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return s.Owns(e.Meta)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return s.Owns(e.Meta)
+		},
+	}
+}
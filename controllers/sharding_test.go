@@ -0,0 +1,78 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+var _ = Describe("Shard", func() {
+	shards := []Shard{{Index: 0, Count: 3}, {Index: 1, Count: 3}, {Index: 2, Count: 3}}
+
+	owners := func(obj metav1.Object) int {
+		count := 0
+		for _, shard := range shards {
+			if shard.Owns(obj) {
+				count++
+			}
+		}
+		return count
+	}
+
+	It("should own everything when not sharded", func() {
+		obj := &operatorsv1alpha1.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"}}
+		Expect(Shard{}.Owns(obj)).To(BeTrue())
+	})
+
+	It("should give every object to exactly one shard", func() {
+		for i := 0; i < 100; i++ {
+			obj := &operatorsv1alpha1.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("release-%d", i), Namespace: "default"}}
+			Expect(owners(obj)).To(Equal(1))
+		}
+	})
+
+	It("should keep objects with the same label together", func() {
+		for _, shard := range shards {
+			first := &operatorsv1alpha1.HelmRelease{ObjectMeta: metav1.ObjectMeta{
+				Name: "a", Namespace: "team-a", Labels: map[string]string{operatorsv1alpha1.ShardLabel: "team"},
+			}}
+			second := &operatorsv1alpha1.ClusterHelmRelease{ObjectMeta: metav1.ObjectMeta{
+				Name: "b", Labels: map[string]string{operatorsv1alpha1.ShardLabel: "team"},
+			}}
+			Expect(shard.Owns(first)).To(Equal(shard.Owns(second)))
+		}
+	})
+	It("should keep children with their controller", func() {
+		owner := &operatorsv1alpha1.NginxIngress{ObjectMeta: metav1.ObjectMeta{Name: "edge", Namespace: "default", UID: "edge-uid"}}
+		for i := 0; i < 20; i++ {
+			child := &operatorsv1alpha1.HelmRelease{ObjectMeta: metav1.ObjectMeta{
+				Name:            fmt.Sprintf("edge-%d", i),
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(owner, operatorsv1alpha1.GroupVersion.WithKind("NginxIngress"))},
+			}}
+			for _, shard := range shards {
+				Expect(shard.Owns(child)).To(Equal(shard.Owns(owner)))
+			}
+		}
+	})
+})
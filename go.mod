@@ -30,19 +30,23 @@ require (
 	github.com/alexeldeib/cloud v0.0.0-20190603144559-0cad37135bab
 	github.com/cyphar/filepath-securejoin v0.2.2 // indirect
 	github.com/go-logr/logr v0.1.0
+	github.com/google/gofuzz v1.0.0
 	github.com/gobwas/glob v0.2.3 // indirect
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/huandu/xstrings v1.2.0 // indirect
 	github.com/onsi/ginkgo v1.8.0
 	github.com/onsi/gomega v1.5.0
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v0.9.0
 	golang.org/x/net v0.0.0-20190501004415-9ce7a6920f09
+	k8s.io/api v0.0.0-20190409021203-6e4e0e4f393b
 	k8s.io/apimachinery v0.0.0-20190404173353-6a84e37a896d
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
 	k8s.io/gengo v0.0.0-20190327210449-e17681d19d3a // indirect
 	k8s.io/helm v2.14.0+incompatible
 	sigs.k8s.io/controller-runtime v0.2.0-beta.1
 	sigs.k8s.io/controller-tools v0.2.0-beta.1 // indirect
+	sigs.k8s.io/yaml v1.1.0
 	vbom.ml/util v0.0.0-20180919145318-efcd4e0f9787 // indirect
 )
 
@@ -15,23 +15,38 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io"
+	"net/http"
 	"os"
-	"os/exec"
-	"sync"
+	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	cloudv1alpha1 "github.com/alexeldeib/cloud/api/v1alpha1"
 	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	operatorsv1beta1 "github.com/alexeldeib/operators/api/v1beta1"
 	"github.com/alexeldeib/operators/controllers"
+	"github.com/alexeldeib/operators/pkg/config"
+	"github.com/alexeldeib/operators/pkg/healthz"
+	"github.com/alexeldeib/operators/pkg/helm"
+	"github.com/alexeldeib/operators/pkg/metrics"
 
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -40,104 +55,371 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// helmInitBackoff spaces out attempts to init helm at startup, giving up after
+// about half a minute.
+var helmInitBackoff = wait.Backoff{Duration: 2 * time.Second, Factor: 2, Steps: 5}
+
+// healthCheckTimeout bounds each helm readiness check. The checks run
+// concurrently, so it also bounds /readyz, which must answer within the
+// probe's timeoutSeconds of 10.
+const healthCheckTimeout = 8 * time.Second
+
 func init() {
+	clientgoscheme.AddToScheme(scheme)
 	operatorsv1alpha1.AddToScheme(scheme)
+	operatorsv1beta1.AddToScheme(scheme)
 	cloudv1alpha1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
-	var metricsAddr string
+	var metricsAddr, healthAddr string
+	var enableWebhooks bool
+	var orphanCheckInterval, orphanPurgeAfter time.Duration
+	var enableLeaderElection bool
+	var leaderElectionNamespace, leaderElectionID string
+	var leaseDuration, renewDeadline, retryPeriod time.Duration
+	var shard controllers.Shard
+	var namespaces, selector string
+	var configFile string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&healthAddr, "health-addr", ":8081", "The address the /healthz and /readyz probe endpoints bind to.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false, "Serve the admission and conversion webhooks. Requires serving certificates in /tmp/k8s-webhook-server/serving-certs.")
+	flag.DurationVar(&orphanCheckInterval, "orphan-check-interval", 10*time.Minute, "How often to look for helm releases whose HelmRelease no longer exists. Zero disables the check.")
+	flag.DurationVar(&orphanPurgeAfter, "orphan-purge-after", 0, "Purge orphaned helm releases after they have been orphaned this long. Zero only reports them.")
+	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Enable leader election, ensuring only one replica reconciles each shard at a time.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "The namespace holding the leader election lock. Defaults to the manager's own namespace.")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "operators-controller-leader", "The name of the leader election lock. Sharded managers append the shard index.")
+	flag.DurationVar(&leaseDuration, "leader-election-lease-duration", 15*time.Second, "How long non-leaders wait before taking over an expired lease.")
+	flag.DurationVar(&renewDeadline, "leader-election-renew-deadline", 10*time.Second, "How long the leader keeps retrying to renew its lease before giving it up.")
+	flag.DurationVar(&retryPeriod, "leader-election-retry-period", 2*time.Second, "How long to wait between leader election attempts.")
+	flag.IntVar(&shard.Count, "shards", 1, "The number of shards to split HelmReleases, ClusterHelmReleases and NginxIngresses into, by hash of their "+operatorsv1alpha1.ShardLabel+" label or key.")
+	flag.IntVar(&shard.Index, "shard-index", -1, "The shard reconciled by this replica. Defaults to the ordinal of the StatefulSet pod modulo --shards, so a StatefulSet of k times --shards replicas runs k replicas of each shard, all but one standing by.")
+	flag.StringVar(&namespaces, "namespaces", "", "Comma separated namespaces to watch. Defaults to all namespaces. ClusterHelmReleases are not reconciled when set.")
+	flag.StringVar(&selector, "selector", "", "Label selector limiting the HelmReleases, ClusterHelmReleases and NginxIngresses reconciled, e.g. team=a.")
+	flag.StringVar(&configFile, "config", "", "Path of the OperatorConfig file. It is reloaded on SIGHUP. Defaults apply when unset.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.Logger(true))
 
-	initCmd := exec.Command("/helm", "init", "--client-only")
+	// Every helm invocation derives from ctx, so a shutdown signal kills
+	// in-flight helm processes instead of leaving them orphaned.
+	stop := ctrl.SetupSignalHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
 
-	var outbuf, errbuf bytes.Buffer
-	stdoutIn, err := initCmd.StdoutPipe()
-	if err != nil {
-		setupLog.Error(err, "failed to attach stdout pipe for helm")
+	var scope controllers.Scope
+	if namespaces != "" {
+		scope.Namespaces = strings.Split(namespaces, ",")
 	}
-
-	stderrIn, err := initCmd.StderrPipe()
-	if err != nil {
-		setupLog.Error(err, "failed to attach stderr pipe for helm")
+	if selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			setupLog.Error(err, "invalid label selector", "selector", selector)
+			os.Exit(1)
+		}
+		scope.Selector = parsed
 	}
 
-	var errStdout, errStderr error
-	stdout := io.MultiWriter(os.Stdout, &outbuf)
-	stderr := io.MultiWriter(os.Stderr, &errbuf)
-
-	setupLog.Info("Executing helm initializaion")
+	if shard.Count > 1 {
+		// Pods past the first --shards ordinals wrap around, standing by for
+		// the leader of their shard.
+		if shard.Index < 0 {
+			if ordinal := podOrdinal(); ordinal >= 0 {
+				shard.Index = ordinal % shard.Count
+			}
+		}
+		if shard.Index < 0 || shard.Index >= shard.Count {
+			setupLog.Info("invalid shard index, pass --shard-index or run as a StatefulSet", "index", shard.Index, "shards", shard.Count)
+			os.Exit(1)
+		}
+		leaderElectionID = fmt.Sprintf("%s-shard-%d", leaderElectionID, shard.Index)
+		setupLog.Info("reconciling a single shard", "index", shard.Index, "shards", shard.Count)
+	}
 
-	if err = initCmd.Start(); err != nil {
-		setupLog.Error(err, "failed to init helm")
+	cfg := config.Defaults()
+	if configFile != "" {
+		loaded, err := config.Load(configFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load configuration")
+			os.Exit(1)
+		}
+		cfg = loaded
 	}
+	configStore := config.NewStore(configFile, cfg)
+	operatorsv1alpha1.SetDefaultNginxIngressChart(cfg.Charts.NginxIngress)
 
-	// Wait with progress.
-	var wg sync.WaitGroup
-	wg.Add(1)
+	helmClient := helm.New(cfg.Helm.Path, ctrl.Log.WithName("helm"))
 
-	go func() {
-		_, errStdout = io.Copy(stdout, stdoutIn)
-		wg.Done()
-	}()
+	removed, err := helm.RemoveStaleValuesFiles(os.TempDir())
+	if err != nil {
+		setupLog.Error(err, "unable to remove stale values files")
+	}
+	if len(removed) > 0 {
+		setupLog.Info("removed stale values files", "count", len(removed))
+	}
 
-	_, errStderr = io.Copy(stderr, stderrIn)
-	wg.Wait()
+	// helm init refreshes the stable repository over the network, so retry
+	// before giving up; without initialized repositories no chart installs.
+	setupLog.Info("Executing helm initializaion")
+	err = wait.ExponentialBackoff(helmInitBackoff, func() (bool, error) {
+		if err := helmClient.Init(ctx); err != nil {
+			setupLog.Error(err, "failed to init helm, retrying")
+			return false, nil
+		}
+		if err := addRepositories(ctx, helmClient, cfg.Helm.Repositories); err != nil {
+			setupLog.Error(err, "failed to add helm repositories, retrying")
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == nil {
+		err = helmClient.CheckClient(ctx)
+	}
+	if err != nil {
+		setupLog.Error(err, "unable to init helm")
+		os.Exit(1)
+	}
+	setupLog.Info("successfully init helm")
 
-	err = initCmd.Wait()
-	if errStderr != nil {
-		setupLog.Error(errStderr, "Unable to log stderr from helm", "errStderr")
+	options := ctrl.Options{
+		Scheme:                  scheme,
+		MetricsBindAddress:      metricsAddr,
+		LeaderElection:          enableLeaderElection,
+		LeaderElectionNamespace: leaderElectionNamespace,
+		LeaderElectionID:        leaderElectionID,
+		LeaseDuration:           &leaseDuration,
+		RenewDeadline:           &renewDeadline,
+		RetryPeriod:             &retryPeriod,
+		SyncPeriod:              &cfg.Resync.SyncPeriod.Duration,
 	}
-	if errStdout != nil {
-		setupLog.Error(errStdout, "Unable to log stdout from helm", "errStdout")
+	// Watching only some namespaces lets the manager run on namespaced Roles.
+	switch len(scope.Namespaces) {
+	case 0:
+	case 1:
+		options.Namespace = scope.Namespaces[0]
+	default:
+		options.NewCache = cache.MultiNamespacedCacheBuilder(scope.Namespaces)
 	}
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
-		// Ok is true if the error is non-nil and indicates the command ran to completion with non-zero exit code.
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				setupLog.Error(err, fmt.Sprintf("helm exited with code %d,\n stdout: %s,\n stderr: %s\n", status.ExitStatus(), string(outbuf.Bytes()), string(errbuf.Bytes())))
-			}
-		} else {
-			// Err is non-nil but the error came from waiting/executing rather than from the running command exiting with error.
-			setupLog.Error(err, "failed to wait on helm")
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+
+	// Liveness only needs the process to answer; readiness follows the helm
+	// backend, which the controllers cannot work without.
+	health := &healthz.Server{
+		Addr:     healthAddr,
+		Liveness: map[string]healthz.Checker{"ping": healthz.Ping},
+		Readiness: map[string]healthz.Checker{
+			"helm": func(req *http.Request) error {
+				checkCtx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+				defer cancel()
+				return helmClient.CheckClient(checkCtx)
+			},
+			"tiller": func(req *http.Request) error {
+				checkCtx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+				defer cancel()
+				return helmClient.CheckTiller(checkCtx)
+			},
+		},
+	}
+	go func() {
+		if err := health.Start(stop); err != nil {
+			setupLog.Error(err, "problem serving health probes")
+			os.Exit(1)
 		}
+	}()
+
+	reconciles := func(obj metav1.Object) bool {
+		return scope.Contains(obj) && shard.Owns(obj)
+	}
+	if err := metrics.RegisterStateCollector(mgr.GetClient(), !scope.ContainsNamespace(""), reconciles); err != nil {
+		setupLog.Error(err, "unable to register metrics collector")
+		os.Exit(1)
 	}
-	setupLog.Info("successfully init helm")
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{Scheme: scheme, MetricsBindAddress: metricsAddr})
+	// Recovery, the orphan collector and values sources read directly from
+	// the API server rather than trusting, or filling, the manager's cache.
+	reader, err := client.New(mgr.GetConfig(), client.Options{Scheme: scheme})
 	if err != nil {
-		setupLog.Error(err, "unable to start manager")
+		setupLog.Error(err, "unable to create uncached client")
 		os.Exit(1)
 	}
 
-	err = (&controllers.HelmReleaseReconciler{
-		Client:   mgr.GetClient(),
-		Recorder: mgr.GetEventRecorderFor("HelmRelease"),
-		Log:      ctrl.Log.WithName("controllers").WithName("HelmRelease"),
-	}).SetupWithManager(mgr)
+	recovered := make(chan struct{})
+	helmReleaseReconciler := &controllers.HelmReleaseReconciler{
+		Client:    mgr.GetClient(),
+		Recorder:  mgr.GetEventRecorderFor("HelmRelease"),
+		Log:       ctrl.Log.WithName("controllers").WithName("HelmRelease"),
+		Helm:      helmClient,
+		Context:   ctx,
+		Config:    configStore,
+		Scope:     scope,
+		Shard:     shard,
+		Recovered: recovered,
+		Reader:    reader,
+	}
+
+	// Recovery rolls back pending releases, so it must wait for leadership:
+	// on a replica that is not leading, they are pending because the leader
+	// is deploying them. Reconciles wait for it in turn.
+	if cfg.Enabled(config.PendingRecovery) {
+		err = mgr.Add(manager.RunnableFunc(func(<-chan struct{}) error {
+			defer close(recovered)
+			if err := helmReleaseReconciler.RecoverPendingReleases(ctx, reader); err != nil {
+				setupLog.Error(err, "unable to recover pending helm releases")
+			}
+			return nil
+		}))
+		if err != nil {
+			setupLog.Error(err, "unable to add pending release recovery")
+			os.Exit(1)
+		}
+	} else {
+		close(recovered)
+	}
+
+	err = helmReleaseReconciler.SetupWithManager(mgr)
 	if err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "HelmRelease")
 		os.Exit(1)
 	}
+	if scope.ContainsNamespace("") {
+		err = (&controllers.ClusterHelmReleaseReconciler{
+			Client:    mgr.GetClient(),
+			Recorder:  mgr.GetEventRecorderFor("ClusterHelmRelease"),
+			Log:       ctrl.Log.WithName("controllers").WithName("ClusterHelmRelease"),
+			Helm:      helmClient,
+			Context:   ctx,
+			Config:    configStore,
+			Scope:     scope,
+			Shard:     shard,
+			Recovered: recovered,
+			Reader:    reader,
+		}).SetupWithManager(mgr)
+		if err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ClusterHelmRelease")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("not reconciling ClusterHelmReleases outside of a cluster-wide scope")
+	}
 	err = (&controllers.NginxIngressReconciler{
 		Client:   mgr.GetClient(),
 		Recorder: mgr.GetEventRecorderFor("NginxIngress"),
 		Scheme:   scheme,
 		Log:      ctrl.Log.WithName("controllers").WithName("NginxIngress"),
+		Config:   configStore,
+		Scope:    scope,
+		Shard:    shard,
 	}).SetupWithManager(mgr)
 	if err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NginxIngress")
 		os.Exit(1)
 	}
+	// Orphans have no object left to shard or select by, so the first shard of
+	// an unrestricted manager owns them.
+	if cfg.Enabled(config.OrphanCollection) && orphanCheckInterval > 0 && shard.Index <= 0 && !scope.Restricted() {
+		err = mgr.Add(&controllers.OrphanCollector{
+			Reader:     reader,
+			Helm:       helmClient,
+			Recorder:   mgr.GetEventRecorderFor("OrphanCollector"),
+			Log:        ctrl.Log.WithName("controllers").WithName("OrphanCollector"),
+			Interval:   orphanCheckInterval,
+			PurgeAfter: orphanPurgeAfter,
+			Context:    ctx,
+		})
+		if err != nil {
+			setupLog.Error(err, "unable to add orphaned release collector")
+			os.Exit(1)
+		}
+	}
+	if enableWebhooks {
+		// The ingress class check must see every NginxIngress, not only the
+		// cached ones in the namespaces this operator manages.
+		operatorsv1alpha1.SetNginxIngressReader(reader)
+		if err = (&operatorsv1alpha1.HelmRelease{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "HelmRelease")
+			os.Exit(1)
+		}
+		if err = (&operatorsv1alpha1.ClusterHelmRelease{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterHelmRelease")
+			os.Exit(1)
+		}
+		if err = (&operatorsv1alpha1.NginxIngress{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "NginxIngress")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	if configFile != "" {
+		go reloadOnHangup(ctx, configStore, helmClient)
+	}
+
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(stop); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// podOrdinal returns the ordinal of this StatefulSet pod, taken from the end
+// of its hostname, or -1 if the hostname has none.
+func podOrdinal() int {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(hostname[strings.LastIndex(hostname, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
+
+// addRepositories adds the configured chart repositories to helm.
+func addRepositories(ctx context.Context, helmClient *helm.Client, repositories []config.Repository) error {
+	for _, repo := range repositories {
+		if err := helmClient.AddRepository(ctx, repo.Name, repo.URL); err != nil {
+			return errors.Wrapf(err, "failed to add helm repository %s", repo.Name)
+		}
+	}
+	return nil
+}
+
+// reloadOnHangup reloads the configuration whenever the manager receives
+// SIGHUP, until ctx is done. A file which fails validation is ignored.
+func reloadOnHangup(ctx context.Context, store *config.Store, helmClient *helm.Client) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		restart, err := store.Reload()
+		if err != nil {
+			setupLog.Error(err, "unable to reload configuration, keeping the current one")
+			continue
+		}
+		if len(restart) > 0 {
+			setupLog.Info("configuration changes take effect on restart", "fields", restart)
+		}
+		cfg := store.Get()
+		operatorsv1alpha1.SetDefaultNginxIngressChart(cfg.Charts.NginxIngress)
+		if err := addRepositories(ctx, helmClient, cfg.Helm.Repositories); err != nil {
+			setupLog.Error(err, "unable to add helm repositories")
+		}
+		setupLog.Info("reloaded configuration")
+	}
+}
@@ -0,0 +1,254 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads the manager's configuration file.
+package config
+
+import (
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+	"github.com/alexeldeib/operators/pkg/helm"
+)
+
+// The version and kind every configuration file must declare.
+const (
+	APIVersion = "config.operators.alexeldeib.xyz/v1alpha1"
+	Kind       = "OperatorConfig"
+)
+
+// Feature gates. All of them are enabled by default.
+const (
+	// Adoption lets HelmReleases take over existing helm releases through the
+	// adopt annotation.
+	Adoption = "Adoption"
+	// PendingRecovery rolls back releases left pending by a killed manager
+	// when the manager starts.
+	PendingRecovery = "PendingRecovery"
+	// OrphanCollection reports, and optionally purges, helm releases whose
+	// HelmRelease is gone.
+	OrphanCollection = "OrphanCollection"
+)
+
+var defaultFeatureGates = map[string]bool{
+	Adoption:         true,
+	PendingRecovery:  true,
+	OrphanCollection: true,
+}
+
+// Defaults for fields left empty.
+const (
+	DefaultHelmPath           = helm.DefaultPath
+	DefaultNginxIngressChart  = operatorsv1alpha1.DefaultNginxIngressChart
+	DefaultSyncPeriod         = 10 * time.Hour
+	DefaultLoadBalancerPoll   = 10 * time.Second
+	DefaultPublicIPTimeout    = 10 * time.Minute
+	DefaultConcurrentReleases = 1
+)
+
+// OperatorConfig is the manager's configuration file. Fields marked as
+// requiring a restart keep their old value when the file is reloaded.
+type OperatorConfig struct {
+	APIVersion   string            `json:"apiVersion"`
+	Kind         string            `json:"kind"`
+	Helm         HelmConfig        `json:"helm,omitempty"`
+	Charts       ChartsConfig      `json:"charts,omitempty"`
+	Resync       ResyncConfig      `json:"resync,omitempty"`
+	Timeouts     TimeoutsConfig    `json:"timeouts,omitempty"`
+	Concurrency  ConcurrencyConfig `json:"concurrency,omitempty"`
+	FeatureGates map[string]bool   `json:"featureGates,omitempty"`
+}
+
+// HelmConfig configures the helm backend.
+type HelmConfig struct {
+	// Path is the location of the helm binary. Requires a restart. Defaults
+	// to /helm.
+	Path string `json:"path,omitempty"`
+	// Repositories are added after helm init, in order, so charts can be
+	// referenced as <name>/<chart>.
+	Repositories []Repository `json:"repositories,omitempty"`
+}
+
+// Repository is a chart repository.
+type Repository struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// ChartsConfig sets the charts installed when an object does not name one.
+type ChartsConfig struct {
+	// NginxIngress defaults NginxIngressSpec.Chart. Defaults to
+	// stable/nginx-ingress.
+	NginxIngress string `json:"nginxIngress,omitempty"`
+}
+
+// ResyncConfig sets how often objects are reconciled without a change.
+type ResyncConfig struct {
+	// SyncPeriod is how often every watched object is reconciled. Requires a
+	// restart. Defaults to 10 hours.
+	SyncPeriod *metav1.Duration `json:"syncPeriod,omitempty"`
+	// LoadBalancerPoll is how often an NginxIngress checks on the load
+	// balancer Services of its release while it waits for them to release a
+	// public IP. Its own children are watched rather than polled. Defaults to
+	// 10 seconds.
+	LoadBalancerPoll *metav1.Duration `json:"loadBalancerPoll,omitempty"`
+}
+
+// TimeoutsConfig bounds how long the manager waits on cloud resources before
+// reporting a failure.
+type TimeoutsConfig struct {
+	// PublicIPAllocation is how long an NginxIngress waits for its public IP
+	// to be allocated before reporting it as failed. It keeps waiting after
+	// that. Defaults to 10 minutes.
+	PublicIPAllocation *metav1.Duration `json:"publicIPAllocation,omitempty"`
+}
+
+// ConcurrencyConfig bounds how many objects of each kind are reconciled at
+// once. Requires a restart. Each defaults to 1.
+type ConcurrencyConfig struct {
+	HelmReleases        int `json:"helmReleases,omitempty"`
+	ClusterHelmReleases int `json:"clusterHelmReleases,omitempty"`
+	NginxIngresses      int `json:"nginxIngresses,omitempty"`
+}
+
+// Defaults returns the configuration used when no file is given.
+func Defaults() *OperatorConfig {
+	cfg := &OperatorConfig{APIVersion: APIVersion, Kind: Kind}
+	cfg.SetDefaults()
+	return cfg
+}
+
+// Load reads, defaults and validates the configuration file at path.
+func Load(path string) (*OperatorConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read configuration")
+	}
+	cfg := &OperatorConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse configuration %s", path)
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate().ToAggregate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid configuration %s", path)
+	}
+	return cfg, nil
+}
+
+// SetDefaults fills in empty fields.
+func (c *OperatorConfig) SetDefaults() {
+	if c.Helm.Path == "" {
+		c.Helm.Path = DefaultHelmPath
+	}
+	if c.Charts.NginxIngress == "" {
+		c.Charts.NginxIngress = DefaultNginxIngressChart
+	}
+	if c.Resync.SyncPeriod == nil {
+		c.Resync.SyncPeriod = &metav1.Duration{Duration: DefaultSyncPeriod}
+	}
+	if c.Resync.LoadBalancerPoll == nil {
+		c.Resync.LoadBalancerPoll = &metav1.Duration{Duration: DefaultLoadBalancerPoll}
+	}
+	if c.Timeouts.PublicIPAllocation == nil {
+		c.Timeouts.PublicIPAllocation = &metav1.Duration{Duration: DefaultPublicIPTimeout}
+	}
+	for _, n := range []*int{&c.Concurrency.HelmReleases, &c.Concurrency.ClusterHelmReleases, &c.Concurrency.NginxIngresses} {
+		if *n == 0 {
+			*n = DefaultConcurrentReleases
+		}
+	}
+}
+
+// Validate reports every invalid field.
+func (c *OperatorConfig) Validate() field.ErrorList {
+	var allErrs field.ErrorList
+	if c.APIVersion != APIVersion {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{APIVersion}))
+	}
+	if c.Kind != Kind {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{Kind}))
+	}
+
+	names := map[string]bool{}
+	for i, repo := range c.Helm.Repositories {
+		path := field.NewPath("helm", "repositories").Index(i)
+		switch {
+		case repo.Name == "":
+			allErrs = append(allErrs, field.Required(path.Child("name"), ""))
+		case names[repo.Name]:
+			allErrs = append(allErrs, field.Duplicate(path.Child("name"), repo.Name))
+		}
+		names[repo.Name] = true
+		if u, err := url.Parse(repo.URL); err != nil || !u.IsAbs() {
+			allErrs = append(allErrs, field.Invalid(path.Child("url"), repo.URL, "must be an absolute URL"))
+		}
+	}
+
+	resync := field.NewPath("resync")
+	allErrs = append(allErrs, validatePositive(resync.Child("syncPeriod"), c.Resync.SyncPeriod)...)
+	allErrs = append(allErrs, validatePositive(resync.Child("loadBalancerPoll"), c.Resync.LoadBalancerPoll)...)
+	allErrs = append(allErrs, validatePositive(field.NewPath("timeouts", "publicIPAllocation"), c.Timeouts.PublicIPAllocation)...)
+
+	concurrency := field.NewPath("concurrency")
+	allErrs = append(allErrs, validateConcurrency(concurrency.Child("helmReleases"), c.Concurrency.HelmReleases)...)
+	allErrs = append(allErrs, validateConcurrency(concurrency.Child("clusterHelmReleases"), c.Concurrency.ClusterHelmReleases)...)
+	allErrs = append(allErrs, validateConcurrency(concurrency.Child("nginxIngresses"), c.Concurrency.NginxIngresses)...)
+
+	gates := make([]string, 0, len(c.FeatureGates))
+	for gate := range c.FeatureGates {
+		gates = append(gates, gate)
+	}
+	sort.Strings(gates)
+	for _, gate := range gates {
+		if _, ok := defaultFeatureGates[gate]; !ok {
+			allErrs = append(allErrs, field.NotSupported(field.NewPath("featureGates").Key(gate), gate, knownFeatureGates()))
+		}
+	}
+	return allErrs
+}
+
+func validatePositive(path *field.Path, d *metav1.Duration) field.ErrorList {
+	if d != nil && d.Duration <= 0 {
+		return field.ErrorList{field.Invalid(path, d.Duration.String(), "must be positive")}
+	}
+	return nil
+}
+
+func validateConcurrency(path *field.Path, n int) field.ErrorList {
+	if n < 0 {
+		return field.ErrorList{field.Invalid(path, n, "must not be negative")}
+	}
+	return nil
+}
+
+// Enabled reports whether the named feature gate is on.
+func (c *OperatorConfig) Enabled(gate string) bool {
+	if enabled, ok := c.FeatureGates[gate]; ok {
+		return enabled
+	}
+	return defaultFeatureGates[gate]
+}
+
+func knownFeatureGates() []string {
+	return []string{Adoption, OrphanCollection, PendingRecovery}
+}
@@ -0,0 +1,175 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OperatorConfig", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config-test")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "config.yaml")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	write := func(content string) {
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	}
+
+	It("defaults an empty configuration", func() {
+		write("apiVersion: config.operators.alexeldeib.xyz/v1alpha1\nkind: OperatorConfig\n")
+		cfg, err := Load(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg).To(Equal(Defaults()))
+		Expect(cfg.Helm.Path).To(Equal("/helm"))
+		Expect(cfg.Resync.LoadBalancerPoll.Duration).To(Equal(10 * time.Second))
+		Expect(cfg.Enabled(Adoption)).To(BeTrue())
+	})
+
+	It("loads every section", func() {
+		write(`apiVersion: config.operators.alexeldeib.xyz/v1alpha1
+kind: OperatorConfig
+helm:
+  path: /usr/local/bin/helm
+  repositories:
+  - name: ingress-nginx
+    url: https://kubernetes.github.io/ingress-nginx
+charts:
+  nginxIngress: ingress-nginx/ingress-nginx
+resync:
+  syncPeriod: 1h
+timeouts:
+  publicIPAllocation: 30m
+concurrency:
+  helmReleases: 4
+featureGates:
+  Adoption: false
+`)
+		cfg, err := Load(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Helm.Path).To(Equal("/usr/local/bin/helm"))
+		Expect(cfg.Helm.Repositories).To(Equal([]Repository{{Name: "ingress-nginx", URL: "https://kubernetes.github.io/ingress-nginx"}}))
+		Expect(cfg.Charts.NginxIngress).To(Equal("ingress-nginx/ingress-nginx"))
+		Expect(cfg.Resync.SyncPeriod.Duration).To(Equal(time.Hour))
+		Expect(cfg.Timeouts.PublicIPAllocation.Duration).To(Equal(30 * time.Minute))
+		Expect(cfg.Concurrency.HelmReleases).To(Equal(4))
+		Expect(cfg.Concurrency.NginxIngresses).To(Equal(1))
+		Expect(cfg.Enabled(Adoption)).To(BeFalse())
+		Expect(cfg.Enabled(OrphanCollection)).To(BeTrue())
+	})
+
+	It("rejects unknown versions, fields and gates", func() {
+		write("apiVersion: config.operators.alexeldeib.xyz/v2\nkind: OperatorConfig\n")
+		_, err := Load(path)
+		Expect(err).To(MatchError(ContainSubstring("apiVersion")))
+
+		write("apiVersion: config.operators.alexeldeib.xyz/v1alpha1\nkind: OperatorConfig\nhelm:\n  paht: /helm\n")
+		_, err = Load(path)
+		Expect(err).To(MatchError(ContainSubstring("paht")))
+
+		write("apiVersion: config.operators.alexeldeib.xyz/v1alpha1\nkind: OperatorConfig\nfeatureGates:\n  Teleport: true\n")
+		_, err = Load(path)
+		Expect(err).To(MatchError(ContainSubstring("featureGates[Teleport]")))
+	})
+
+	It("rejects invalid values", func() {
+		write(`apiVersion: config.operators.alexeldeib.xyz/v1alpha1
+kind: OperatorConfig
+helm:
+  repositories:
+  - name: stable
+    url: charts
+  - name: stable
+    url: https://charts.example.com
+resync:
+  loadBalancerPoll: 0s
+concurrency:
+  nginxIngresses: -1
+`)
+		_, err := Load(path)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("helm.repositories[0].url"))
+		Expect(err.Error()).To(ContainSubstring("helm.repositories[1].name"))
+		Expect(err.Error()).To(ContainSubstring("resync.loadBalancerPoll"))
+		Expect(err.Error()).To(ContainSubstring("concurrency.nginxIngresses"))
+	})
+})
+
+var _ = Describe("Store", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config-test")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "config.yaml")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("holds the defaults when nil", func() {
+		var store *Store
+		Expect(store.Get()).To(Equal(Defaults()))
+	})
+
+	It("applies safe changes and keeps the rest until restart", func() {
+		store := NewStore(path, Defaults())
+		Expect(ioutil.WriteFile(path, []byte(`apiVersion: config.operators.alexeldeib.xyz/v1alpha1
+kind: OperatorConfig
+helm:
+  path: /usr/local/bin/helm
+charts:
+  nginxIngress: ingress-nginx/ingress-nginx
+featureGates:
+  Adoption: false
+  OrphanCollection: false
+`), 0644)).To(Succeed())
+
+		restart, err := store.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restart).To(ConsistOf("helm.path", "featureGates.OrphanCollection"))
+
+		cfg := store.Get()
+		Expect(cfg.Charts.NginxIngress).To(Equal("ingress-nginx/ingress-nginx"))
+		Expect(cfg.Enabled(Adoption)).To(BeFalse())
+		Expect(cfg.Helm.Path).To(Equal("/helm"))
+		Expect(cfg.Enabled(OrphanCollection)).To(BeTrue())
+	})
+
+	It("keeps the configuration in effect when the file is invalid", func() {
+		store := NewStore(path, Defaults())
+		Expect(ioutil.WriteFile(path, []byte("kind: Nonsense\n"), 0644)).To(Succeed())
+		_, err := store.Reload()
+		Expect(err).To(HaveOccurred())
+		Expect(store.Get()).To(Equal(Defaults()))
+	})
+})
@@ -0,0 +1,96 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Store holds the configuration in effect. A nil Store holds the defaults.
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	current *OperatorConfig
+}
+
+// NewStore returns a Store holding cfg, which Reload replaces from path.
+func NewStore(path string, cfg *OperatorConfig) *Store {
+	return &Store{path: path, current: cfg}
+}
+
+// Get returns the configuration in effect. It must not be modified; a reload
+// replaces it rather than changing it.
+func (s *Store) Get() *OperatorConfig {
+	if s == nil {
+		return Defaults()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// Reload reads the configuration file again. An invalid file is rejected as a
+// whole and the configuration in effect is kept. Fields which only take
+// effect on start keep their old value; their paths are returned so the
+// caller can ask for a restart.
+func (s *Store) Reload() ([]string, error) {
+	if s.path == "" {
+		return nil, errors.New("no configuration file to reload")
+	}
+	next, err := Load(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restart := keepRestartOnly(s.current, next)
+	s.current = next
+	return restart, nil
+}
+
+// keepRestartOnly copies the fields which require a restart from current to
+// next, returning the paths of those which differed.
+func keepRestartOnly(current, next *OperatorConfig) []string {
+	var changed []string
+	if next.Helm.Path != current.Helm.Path {
+		changed = append(changed, "helm.path")
+		next.Helm.Path = current.Helm.Path
+	}
+	if next.Resync.SyncPeriod.Duration != current.Resync.SyncPeriod.Duration {
+		changed = append(changed, "resync.syncPeriod")
+		next.Resync.SyncPeriod = current.Resync.SyncPeriod
+	}
+	if !reflect.DeepEqual(next.Concurrency, current.Concurrency) {
+		changed = append(changed, "concurrency")
+		next.Concurrency = current.Concurrency
+	}
+	// These gates decide what runs at startup.
+	for _, gate := range []string{OrphanCollection, PendingRecovery} {
+		if next.Enabled(gate) != current.Enabled(gate) {
+			changed = append(changed, "featureGates."+gate)
+			if next.FeatureGates == nil {
+				next.FeatureGates = map[string]bool{}
+			}
+			next.FeatureGates[gate] = current.Enabled(gate)
+		}
+	}
+	return changed
+}
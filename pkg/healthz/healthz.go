@@ -0,0 +1,124 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package healthz serves the liveness and readiness endpoints probed by the
+// kubelet.
+package healthz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Checker reports why a component is unhealthy, or nil if it is healthy.
+type Checker func(req *http.Request) error
+
+// Ping is always healthy. It answers as long as the process serves HTTP.
+func Ping(*http.Request) error {
+	return nil
+}
+
+// Handler runs every check on each request, answering 200 if all pass and
+// 500 naming the failures otherwise. Add ?verbose to list passing checks too.
+// The checks run concurrently, so a request takes as long as the slowest
+// check rather than all of them together.
+type Handler struct {
+	Checks map[string]Checker
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	names := make([]string, 0, len(h.Checks))
+	for name := range h.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, check Checker) {
+			defer wg.Done()
+			errs[i] = check(req)
+		}(i, h.Checks[name])
+	}
+	wg.Wait()
+
+	var report strings.Builder
+	failed := false
+	for i, name := range names {
+		if err := errs[i]; err != nil {
+			failed = true
+			fmt.Fprintf(&report, "[-]%s failed: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(&report, "[+]%s ok\n", name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, report.String())
+		fmt.Fprintf(w, "%s check failed\n", strings.TrimPrefix(req.URL.Path, "/"))
+		return
+	}
+	if _, verbose := req.URL.Query()["verbose"]; verbose {
+		fmt.Fprint(w, report.String())
+	}
+	fmt.Fprint(w, "ok\n")
+}
+
+// Server serves /healthz and /readyz.
+type Server struct {
+	// Addr is the address to listen on.
+	Addr string
+	// Liveness checks are served on /healthz. A failure gets the manager
+	// restarted, so they should only fail when restarting helps.
+	Liveness map[string]Checker
+	// Readiness checks are served on /readyz.
+	Readiness map[string]Checker
+}
+
+// Start serves until stop is closed. It does not wait for leader election,
+// so every replica answers its probes.
+func (s *Server) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", &Handler{Checks: s.Liveness})
+	mux.Handle("/readyz", &Handler{Checks: s.Readiness})
+	server := &http.Server{Addr: s.Addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return errors.Wrap(err, "failed to serve health probes")
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
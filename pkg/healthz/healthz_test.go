@@ -0,0 +1,74 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package healthz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Handler", func() {
+	serve := func(h *Handler, url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	It("answers ok when every check passes", func() {
+		rec := serve(&Handler{Checks: map[string]Checker{"ping": Ping}}, "/healthz")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(Equal("ok\n"))
+	})
+
+	It("lists passing checks when asked", func() {
+		rec := serve(&Handler{Checks: map[string]Checker{"ping": Ping}}, "/healthz?verbose")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(Equal("[+]ping ok\nok\n"))
+	})
+
+	It("names the failing checks", func() {
+		rec := serve(&Handler{Checks: map[string]Checker{
+			"ping":   Ping,
+			"tiller": func(*http.Request) error { return errors.New("connection refused") },
+		}}, "/readyz")
+		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
+		Expect(rec.Body.String()).To(Equal("[+]ping ok\n[-]tiller failed: connection refused\nreadyz check failed\n"))
+	})
+
+	It("runs the checks concurrently", func() {
+		started := make(chan struct{})
+		rec := serve(&Handler{Checks: map[string]Checker{
+			"helm": func(*http.Request) error {
+				select {
+				case <-started:
+					return nil
+				case <-time.After(time.Second):
+					return errors.New("tiller was not checked in the meantime")
+				}
+			},
+			"tiller": func(*http.Request) error {
+				close(started)
+				return nil
+			},
+		}}, "/readyz")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+	})
+})
@@ -0,0 +1,457 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package helm wraps the helm CLI so that every invocation is bound to a
+// context and can be cancelled when the manager shuts down.
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/alexeldeib/operators/pkg/metrics"
+	"github.com/alexeldeib/operators/pkg/redact"
+)
+
+// Release statuses as reported by helm list and helm history.
+const (
+	StatusDeployed        = "DEPLOYED"
+	StatusSuperseded      = "SUPERSEDED"
+	StatusFailed          = "FAILED"
+	StatusDeleted         = "DELETED"
+	StatusDeleting        = "DELETING"
+	StatusPendingInstall  = "PENDING_INSTALL"
+	StatusPendingUpgrade  = "PENDING_UPGRADE"
+	StatusPendingRollback = "PENDING_ROLLBACK"
+)
+
+// DefaultPath is where the manager image ships the helm binary.
+const DefaultPath = "/helm"
+
+// DefaultTimeout mirrors helm's own default for --wait operations.
+const DefaultTimeout = 5 * time.Minute
+
+// timeoutGrace is added on top of the helm --timeout when deriving the
+// context deadline, so helm gets a chance to report its own timeout first.
+const timeoutGrace = 30 * time.Second
+
+// Client runs helm commands.
+type Client struct {
+	// Path is the location of the helm binary.
+	Path string
+	Log  logr.Logger
+
+	redactor *redact.Redactor
+}
+
+// New returns a Client for the helm binary at path.
+func New(path string, log logr.Logger) *Client {
+	return &Client{Path: path, Log: log}
+}
+
+// WithRedactor returns a copy of c which masks everything known to redactor
+// in the output it streams and in the errors it returns.
+func (c *Client) WithRedactor(redactor *redact.Redactor) *Client {
+	clone := *c
+	clone.redactor = redactor
+	return &clone
+}
+
+// Error is returned when helm ran to completion with a non-zero exit code.
+// Args, Stdout and Stderr are already redacted.
+type Error struct {
+	Args     []string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("helm exited with code %d,\n stdout: %s,\n stderr: %s\n", e.ExitCode, e.Stdout, e.Stderr)
+}
+
+// IsReleaseNotFound reports whether err is helm complaining that the named
+// release does not exist.
+func IsReleaseNotFound(err error, name string) bool {
+	helmErr, ok := errors.Cause(err).(*Error)
+	if !ok {
+		return false
+	}
+	return strings.Trim(helmErr.Stderr, "\n") == fmt.Sprintf("Error: release: \"%s\" not found", name)
+}
+
+// Release is a single entry of helm list.
+type Release struct {
+	Name       string
+	Revision   int32
+	Updated    string
+	Status     string
+	Chart      string
+	AppVersion string
+	Namespace  string
+}
+
+// Revision is a single entry of helm history.
+type Revision struct {
+	Revision    int32  `json:"revision"`
+	Updated     string `json:"updated"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	Description string `json:"description"`
+}
+
+// UpgradeOptions describes a helm upgrade --install invocation.
+type UpgradeOptions struct {
+	Name  string
+	Chart string
+	// Version pins the chart version. The latest version is installed when
+	// it is empty.
+	Version   string
+	Namespace string
+	// Values is a values.yaml document. It is handed to helm on stdin and
+	// never written to disk.
+	Values    []byte
+	Overrides []string
+	Timeout   time.Duration
+	// Description replaces helm's default description of the new revision,
+	// as shown by helm history.
+	Description string
+}
+
+// TimeoutContext derives a context for an operation bounded by timeout,
+// leaving helm enough room to fail on its own before the context expires.
+func TimeoutContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout+timeoutGrace)
+}
+
+// Init runs helm init --client-only.
+func (c *Client) Init(ctx context.Context) error {
+	_, err := c.Run(ctx, "init", "--client-only")
+	return err
+}
+
+// AddRepository runs helm repo add, replacing any repository of the same
+// name.
+func (c *Client) AddRepository(ctx context.Context, name, url string) error {
+	_, err := c.Run(ctx, "repo", "add", name, url)
+	return err
+}
+
+// tillerConnectionTimeout bounds how long CheckTiller waits for Tiller, in
+// seconds.
+const tillerConnectionTimeout = "5"
+
+// CheckClient verifies that the helm binary runs and that its repositories
+// were initialized by Init. It needs no network.
+func (c *Client) CheckClient(ctx context.Context) error {
+	if _, err := c.run(ctx, false, nil, "repo", "list"); err != nil {
+		if _, ok := errors.Cause(err).(*Error); ok {
+			return errors.Wrap(err, "helm repositories are not initialized")
+		}
+		return errors.Wrap(err, "helm binary is not usable")
+	}
+	return nil
+}
+
+// CheckTiller verifies that Tiller is reachable.
+func (c *Client) CheckTiller(ctx context.Context) error {
+	if _, err := c.run(ctx, false, nil, "version", "--server", "--tiller-connection-timeout", tillerConnectionTimeout); err != nil {
+		return errors.Wrap(err, "tiller is not reachable")
+	}
+	return nil
+}
+
+// History returns the revisions of the named release, oldest first.
+func (c *Client) History(ctx context.Context, name string) ([]Revision, error) {
+	out, err := c.run(ctx, false, nil, "history", name, "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision
+	if err := json.Unmarshal([]byte(out), &revisions); err != nil {
+		return nil, errors.Wrap(err, "failed to parse helm history")
+	}
+	return revisions, nil
+}
+
+// ListPending returns every release stuck in one of the pending states.
+func (c *Client) ListPending(ctx context.Context) ([]Release, error) {
+	return c.list(ctx, "--pending")
+}
+
+// List returns every release known to tiller, whatever its state.
+func (c *Client) List(ctx context.Context) ([]Release, error) {
+	return c.list(ctx, "--all")
+}
+
+// list runs helm list with filter, following helm's paging until every
+// matching release has been read.
+func (c *Client) list(ctx context.Context, filter string) ([]Release, error) {
+	var releases []Release
+	offset := ""
+	for {
+		args := []string{"list", filter, "--output", "json"}
+		if offset != "" {
+			args = append(args, "--offset", offset)
+		}
+		out, err := c.run(ctx, false, nil, args...)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(out) == "" {
+			return releases, nil
+		}
+		var list struct {
+			Next     string
+			Releases []Release
+		}
+		if err := json.Unmarshal([]byte(out), &list); err != nil {
+			return nil, errors.Wrap(err, "failed to parse helm list")
+		}
+		releases = append(releases, list.Releases...)
+		if list.Next == "" || list.Next == offset {
+			return releases, nil
+		}
+		offset = list.Next
+	}
+}
+
+// UpgradeInstall runs helm upgrade --install --wait --atomic for opts.
+func (c *Client) UpgradeInstall(ctx context.Context, opts UpgradeOptions) error {
+	args := []string{"upgrade", "--install", "--wait", "--force", "--atomic", opts.Name, opts.Chart, "--namespace", opts.Namespace}
+	if opts.Version != "" {
+		args = append(args, "--version", opts.Version)
+	}
+	if opts.Timeout > 0 {
+		args = append(args, "--timeout", strconv.Itoa(int(opts.Timeout.Seconds())))
+	}
+	if opts.Description != "" {
+		args = append(args, "--description", opts.Description)
+	}
+	if len(opts.Values) > 0 {
+		args = append(args, "-f", "-")
+	}
+	for _, override := range opts.Overrides {
+		args = append(args, "--set", override)
+	}
+	_, err := c.run(ctx, true, opts.Values, args...)
+	return err
+}
+
+// Rollback rolls the named release back to revision.
+func (c *Client) Rollback(ctx context.Context, name string, revision int32, timeout time.Duration) error {
+	args := []string{"rollback", name, strconv.Itoa(int(revision)), "--wait", "--force"}
+	if timeout > 0 {
+		args = append(args, "--timeout", strconv.Itoa(int(timeout.Seconds())))
+	}
+	_, err := c.Run(ctx, args...)
+	return err
+}
+
+// Delete purges the named release.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	_, err := c.Run(ctx, "delete", name, "--purge")
+	return err
+}
+
+// Run executes helm with args, streaming its output to the manager's own
+// stdout/stderr. The process and its children are killed if ctx is done
+// before it exits.
+func (c *Client) Run(ctx context.Context, args ...string) (string, error) {
+	return c.run(ctx, true, nil, args...)
+}
+
+func (c *Client) run(ctx context.Context, stream bool, stdin []byte, args ...string) (out string, err error) {
+	start := time.Now()
+	defer func() {
+		result := metrics.ResultSuccess
+		if ctx.Err() != nil {
+			result = metrics.ResultCancelled
+		} else if err != nil {
+			result = metrics.ResultFailure
+		}
+		metrics.ObserveHelmOperation(args[0], result, start)
+	}()
+
+	cmd := exec.Command(c.Path, args...)
+	// Run helm in its own process group so cancellation takes down anything
+	// it spawned too; a surviving child would hold the output pipes open.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var outbuf, errbuf bytes.Buffer
+	stdoutIn, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to attach stdout pipe for helm")
+	}
+
+	stderrIn, err := cmd.StderrPipe()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to attach stderr pipe for helm")
+	}
+
+	var errStdout, errStderr error
+	var stdout, stderr io.Writer = &outbuf, &errbuf
+	if stream {
+		streamOut := redact.NewWriter(os.Stdout, c.redactor)
+		streamErr := redact.NewWriter(os.Stderr, c.redactor)
+		defer streamOut.Flush()
+		defer streamErr.Flush()
+		stdout = io.MultiWriter(streamOut, &outbuf)
+		stderr = io.MultiWriter(streamErr, &errbuf)
+	}
+
+	c.Log.V(1).Info("executing helm", "command", args[0])
+
+	if err = cmd.Start(); err != nil {
+		return "", errors.Wrap(err, "failed to start helm")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	// Wait with progress.
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		_, errStdout = io.Copy(stdout, stdoutIn)
+		wg.Done()
+	}()
+
+	_, errStderr = io.Copy(stderr, stderrIn)
+	wg.Wait()
+
+	err = cmd.Wait()
+	if errStderr != nil {
+		c.Log.Error(errStderr, "Unable to log stderr from helm", "errStderr")
+	}
+	if errStdout != nil {
+		c.Log.Error(errStdout, "Unable to log stdout from helm", "errStdout")
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return outbuf.String(), errors.Wrapf(ctxErr, "helm %s interrupted", args[0])
+	}
+	if err != nil {
+		// Ok is true if the error is non-nil and indicates the command ran to completion with non-zero exit code.
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				return outbuf.String(), &Error{
+					Args:     c.redactor.Strings(args),
+					ExitCode: status.ExitStatus(),
+					Stdout:   c.redactor.String(outbuf.String()),
+					Stderr:   c.redactor.String(errbuf.String()),
+				}
+			}
+		}
+		// Err is non-nil but the error came from waiting/executing rather than from the running command exiting with error.
+		return outbuf.String(), errors.Wrap(err, "failed to wait on helm")
+	}
+	return outbuf.String(), nil
+}
+
+// MergeValues coalesces values documents into a single one the way helm
+// merges repeated -f flags: later documents win, and maps are merged key by
+// key rather than replaced.
+func MergeValues(docs ...string) ([]byte, error) {
+	merged := map[string]interface{}{}
+	for i, doc := range docs {
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(doc), &current); err != nil {
+			return nil, errors.Errorf("values document %d is not valid YAML", i)
+		}
+		merged = mergeMaps(merged, current)
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	return yaml.Marshal(merged)
+}
+
+func mergeMaps(dest, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		destMap, destIsMap := dest[k].(map[string]interface{})
+		if srcIsMap && destIsMap {
+			dest[k] = mergeMaps(destMap, srcMap)
+			continue
+		}
+		dest[k] = v
+	}
+	return dest
+}
+
+// RemoveStaleValuesFiles deletes values files left in dir by earlier versions
+// of the manager, which wrote each release's values to an unprefixed
+// ioutil.TempFile and relied on a deferred remove that a crash would skip.
+// Those files have purely numeric names; nothing else in dir is touched.
+func RemoveStaleValuesFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read temp dir")
+	}
+	var removed []string
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !isNumeric(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			return removed, errors.Wrapf(err, "failed to remove stale values file %s", path)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package helm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/alexeldeib/operators/pkg/redact"
+)
+
+// fakeHelm writes a shell script standing in for the helm binary and returns
+// its path.
+func fakeHelm(dir, script string) string {
+	path := filepath.Join(dir, "helm")
+	Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700)).To(Succeed())
+	return path
+}
+
+var _ = Describe("Client", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "helm-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reports a missing release", func() {
+		c := New(fakeHelm(dir, `echo 'Error: release: "foo" not found' >&2; exit 1`), logf.Log)
+		_, err := c.History(context.Background(), "foo")
+		Expect(err).To(HaveOccurred())
+		Expect(IsReleaseNotFound(errors.Wrap(err, "wrapped"), "foo")).To(BeTrue())
+		Expect(IsReleaseNotFound(err, "bar")).To(BeFalse())
+	})
+
+	It("parses history", func() {
+		c := New(fakeHelm(dir, `echo '[{"revision":1,"status":"SUPERSEDED"},{"revision":2,"status":"DEPLOYED"}]'`), logf.Log)
+		revisions, err := c.History(context.Background(), "foo")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(revisions).To(HaveLen(2))
+		Expect(revisions[1].Revision).To(BeEquivalentTo(2))
+		Expect(revisions[1].Status).To(Equal(StatusDeployed))
+	})
+
+	It("reports uninitialized repositories", func() {
+		c := New(fakeHelm(dir, `echo "Error: Couldn't load repositories file" >&2; exit 1`), logf.Log)
+		err := c.CheckClient(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("helm repositories are not initialized")))
+	})
+
+	It("reports a missing helm binary", func() {
+		c := New(filepath.Join(dir, "missing"), logf.Log)
+		err := c.CheckClient(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("helm binary is not usable")))
+	})
+
+	It("follows helm list paging", func() {
+		c := New(fakeHelm(dir, `case "$*" in
+*"--offset b"*) echo '{"Releases":[{"Name":"b"}]}' ;;
+*) echo '{"Next":"b","Releases":[{"Name":"a"}]}' ;;
+esac`), logf.Log)
+		releases, err := c.List(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(releases).To(HaveLen(2))
+		Expect(releases[0].Name).To(Equal("a"))
+		Expect(releases[1].Name).To(Equal("b"))
+	})
+
+	It("kills helm when the context is cancelled", func() {
+		c := New(fakeHelm(dir, `sleep 30`), logf.Log)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := c.Run(ctx, "upgrade")
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Cause(err)).To(Equal(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+	})
+
+	It("does not leak redacted values through errors", func() {
+		const password = "hunter2-s3cr3t"
+		c := New(fakeHelm(dir, `echo "args: $*"; echo "Error: bad value $*" >&2; exit 1`), logf.Log).
+			WithRedactor(redact.New(password))
+		err := c.UpgradeInstall(context.Background(), UpgradeOptions{
+			Name:      "foo",
+			Chart:     "stable/foo",
+			Namespace: "default",
+			Overrides: []string{"db.password=" + password},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).NotTo(ContainSubstring(password))
+		helmErr, ok := errors.Cause(err).(*Error)
+		Expect(ok).To(BeTrue())
+		Expect(helmErr.ExitCode).To(Equal(1))
+		Expect(helmErr.Args).To(ContainElement("db.password=" + redact.Mask))
+		Expect(helmErr.Stdout + helmErr.Stderr).NotTo(ContainSubstring(password))
+	})
+
+	It("hands values to helm on stdin", func() {
+		out := filepath.Join(dir, "out")
+		c := New(fakeHelm(dir, `echo "$*" > `+out+`; cat >> `+out), logf.Log)
+		err := c.UpgradeInstall(context.Background(), UpgradeOptions{
+			Name:      "foo",
+			Chart:     "stable/foo",
+			Namespace: "default",
+			Values:    []byte("replicas: 2\n"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		written, err := ioutil.ReadFile(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(written)).To(ContainSubstring("-f -"))
+		Expect(string(written)).To(ContainSubstring("replicas: 2"))
+	})
+
+	It("passes the revision description", func() {
+		out := filepath.Join(dir, "out")
+		c := New(fakeHelm(dir, `for arg in "$@"; do echo "$arg"; done > `+out), logf.Log)
+		err := c.UpgradeInstall(context.Background(), UpgradeOptions{
+			Name:        "foo",
+			Chart:       "stable/foo",
+			Namespace:   "default",
+			Description: "Managed by HelmRelease default/foo",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		written, err := ioutil.ReadFile(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(written)).To(ContainSubstring("--description\nManaged by HelmRelease default/foo\n"))
+	})
+
+	It("pins the chart version", func() {
+		out := filepath.Join(dir, "out")
+		c := New(fakeHelm(dir, `for arg in "$@"; do echo "$arg"; done > `+out), logf.Log)
+		err := c.UpgradeInstall(context.Background(), UpgradeOptions{
+			Name:      "foo",
+			Chart:     "stable/foo",
+			Version:   "1.6.0",
+			Namespace: "default",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		written, err := ioutil.ReadFile(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(written)).To(ContainSubstring("stable/foo\n--namespace\ndefault\n--version\n1.6.0\n"))
+	})
+
+	It("merges values documents like repeated -f flags", func() {
+		merged, err := MergeValues(
+			"controller:\n  replicas: 1\n  image: nginx\n",
+			"",
+			"controller:\n  replicas: 3\nrbac: true\n",
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(merged)).To(Equal("controller:\n  image: nginx\n  replicas: 3\nrbac: true\n"))
+
+		_, err = MergeValues("a: [")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("removes only stale numeric values files", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "123456"), []byte("password: x"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "keep.yaml"), nil, 0644)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(dir, "7890"), 0700)).To(Succeed())
+
+		removed, err := RemoveStaleValuesFiles(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(ConsistOf(filepath.Join(dir, "123456")))
+		Expect(filepath.Join(dir, "keep.yaml")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "7890")).To(BeADirectory())
+	})
+})
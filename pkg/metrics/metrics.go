@@ -0,0 +1,209 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics defines the operator's custom Prometheus metrics. All of
+// them are registered with the controller-runtime registry, so they are
+// served from the manager's --metrics-addr alongside the default metrics.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// Results recorded for helm operations.
+const (
+	ResultSuccess   = "success"
+	ResultFailure   = "failure"
+	ResultCancelled = "cancelled"
+)
+
+var (
+	// HelmOperationDuration tracks how long each helm invocation took.
+	HelmOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "operators_helm_operation_duration_seconds",
+		Help:    "Duration of helm operations by operation type and result.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"operation", "result"})
+
+	// ValuesFetchFailures counts failures to assemble the values for a release.
+	ValuesFetchFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "operators_helmrelease_values_fetch_failures_total",
+		Help: "Number of failures fetching or materializing values for a HelmRelease, by values source.",
+	}, []string{"namespace", "name", "source"})
+
+	// OrphanedReleases flags helm releases deployed by the operator whose
+	// HelmRelease or ClusterHelmRelease no longer exists.
+	OrphanedReleases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "operators_helm_orphaned_release",
+		Help: "Helm releases deployed by the operator whose owning object no longer exists, by release, namespace and former owner.",
+	}, []string{"release", "namespace", "owner"})
+
+	// OrphanedReleasesPurged counts orphaned helm releases purged after their
+	// grace period.
+	OrphanedReleasesPurged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "operators_helm_orphaned_releases_purged_total",
+		Help: "Number of orphaned helm releases purged by the operator.",
+	})
+
+	releaseRevisionDesc = prometheus.NewDesc(
+		"operators_helmrelease_revision",
+		"Helm revision last observed for a HelmRelease.",
+		[]string{"namespace", "name"}, nil,
+	)
+	releaseReadyDesc = prometheus.NewDesc(
+		"operators_helmrelease_ready",
+		"Whether a HelmRelease is successfully deployed (1) or not (0).",
+		[]string{"namespace", "name"}, nil,
+	)
+	releasePhaseDesc = prometheus.NewDesc(
+		"operators_helmrelease_phase_count",
+		"Number of HelmReleases in each provisioning state.",
+		[]string{"phase"}, nil,
+	)
+	nginxComponentReadyDesc = prometheus.NewDesc(
+		"operators_nginxingress_component_ready",
+		"Whether a component of an NginxIngress is ready (1) or not (0).",
+		[]string{"namespace", "name", "component"}, nil,
+	)
+	nginxConditionDesc = prometheus.NewDesc(
+		"operators_nginxingress_condition",
+		"Whether a condition of an NginxIngress is true (1) or not (0), by condition type.",
+		[]string{"namespace", "name", "condition"}, nil,
+	)
+)
+
+var log = logf.Log.WithName("metrics")
+
+// scrapeTimeout bounds the list calls made while collecting object state.
+const scrapeTimeout = 5 * time.Second
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(HelmOperationDuration, ValuesFetchFailures, OrphanedReleases, OrphanedReleasesPurged)
+}
+
+// ObserveHelmOperation records the duration and result of a helm operation
+// which started at start.
+func ObserveHelmOperation(operation, result string, start time.Time) {
+	HelmOperationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// StateCollector reports per-object state for HelmReleases,
+// ClusterHelmReleases and NginxIngresses. State is read at scrape time so
+// series for deleted objects disappear with them.
+type StateCollector struct {
+	Reader client.Reader
+	// SkipClusterReleases leaves out ClusterHelmReleases, which a manager
+	// restricted to namespaces can neither read nor reconcile.
+	SkipClusterReleases bool
+	// Reconciles, if set, reports whether this replica reconciles obj. Only
+	// those objects are reported, so that managers splitting objects by
+	// scope or shard do not report the same series twice.
+	Reconciles func(obj metav1.Object) bool
+}
+
+// RegisterStateCollector registers a StateCollector reading from reader and
+// reporting the objects for which reconciles is true.
+func RegisterStateCollector(reader client.Reader, skipClusterReleases bool, reconciles func(metav1.Object) bool) error {
+	return ctrlmetrics.Registry.Register(&StateCollector{Reader: reader, SkipClusterReleases: skipClusterReleases, Reconciles: reconciles})
+}
+
+// Describe implements prometheus.Collector.
+func (c *StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- releaseRevisionDesc
+	ch <- releaseReadyDesc
+	ch <- releasePhaseDesc
+	ch <- nginxComponentReadyDesc
+	ch <- nginxConditionDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *StateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	var releases operatorsv1alpha1.HelmReleaseList
+	if err := c.Reader.List(ctx, &releases); err != nil {
+		log.Error(err, "failed to list HelmReleases for metrics")
+	} else {
+		phases := map[string]int{}
+		for _, release := range releases.Items {
+			if !c.reconciles(&release) {
+				continue
+			}
+			collectRelease(ch, release.Namespace, release.Name, &release.Status)
+			phases[release.Status.ProvisioningState]++
+		}
+		// Cluster-scoped releases are reported with an empty namespace.
+		if !c.SkipClusterReleases {
+			var clusterReleases operatorsv1alpha1.ClusterHelmReleaseList
+			if err := c.Reader.List(ctx, &clusterReleases); err != nil {
+				log.Error(err, "failed to list ClusterHelmReleases for metrics")
+			}
+			for _, release := range clusterReleases.Items {
+				if !c.reconciles(&release) {
+					continue
+				}
+				collectRelease(ch, "", release.Name, &release.Status)
+				phases[release.Status.ProvisioningState]++
+			}
+		}
+		for phase, count := range phases {
+			ch <- prometheus.MustNewConstMetric(releasePhaseDesc, prometheus.GaugeValue, float64(count), phase)
+		}
+	}
+
+	var ingresses operatorsv1alpha1.NginxIngressList
+	if err := c.Reader.List(ctx, &ingresses); err != nil {
+		log.Error(err, "failed to list NginxIngresses for metrics")
+		return
+	}
+	for _, ingress := range ingresses.Items {
+		if !c.reconciles(&ingress) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(nginxComponentReadyDesc, prometheus.GaugeValue, boolToFloat(ingress.Status.PublicIPReady), ingress.Namespace, ingress.Name, "publicip")
+		ch <- prometheus.MustNewConstMetric(nginxComponentReadyDesc, prometheus.GaugeValue, boolToFloat(ingress.Status.HelmReleaseReady), ingress.Namespace, ingress.Name, "helmrelease")
+		for _, condition := range ingress.Status.Conditions {
+			ch <- prometheus.MustNewConstMetric(nginxConditionDesc, prometheus.GaugeValue, boolToFloat(condition.Status == corev1.ConditionTrue), ingress.Namespace, ingress.Name, string(condition.Type))
+		}
+	}
+}
+
+func (c *StateCollector) reconciles(obj metav1.Object) bool {
+	return c.Reconciles == nil || c.Reconciles(obj)
+}
+
+func collectRelease(ch chan<- prometheus.Metric, namespace, name string, status *operatorsv1alpha1.HelmReleaseStatus) {
+	ready := status.ProvisioningState == operatorsv1alpha1.ProvisioningStateSucceeded
+	ch <- prometheus.MustNewConstMetric(releaseRevisionDesc, prometheus.GaugeValue, float64(status.Revision), namespace, name)
+	ch <- prometheus.MustNewConstMetric(releaseReadyDesc, prometheus.GaugeValue, boolToFloat(ready), namespace, name)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
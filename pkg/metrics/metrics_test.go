@@ -0,0 +1,137 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	operatorsv1alpha1 "github.com/alexeldeib/operators/api/v1alpha1"
+)
+
+// collect runs c and returns the value of each metric it reported, keyed by
+// its name and labels, which are sorted by label name.
+func collect(c prometheus.Collector) map[string]float64 {
+	names := map[*prometheus.Desc]string{
+		releaseRevisionDesc:     "operators_helmrelease_revision",
+		releaseReadyDesc:        "operators_helmrelease_ready",
+		releasePhaseDesc:        "operators_helmrelease_phase_count",
+		nginxComponentReadyDesc: "operators_nginxingress_component_ready",
+		nginxConditionDesc:      "operators_nginxingress_condition",
+	}
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+
+	values := map[string]float64{}
+	for metric := range ch {
+		var m dto.Metric
+		Expect(metric.Write(&m)).To(Succeed())
+		key := []string{names[metric.Desc()]}
+		for _, label := range m.GetLabel() {
+			key = append(key, label.GetName()+"="+label.GetValue())
+		}
+		values[strings.Join(key, " ")] = m.GetGauge().GetValue()
+	}
+	return values
+}
+
+var _ = Describe("StateCollector", func() {
+	var objs []runtime.Object
+
+	BeforeEach(func() {
+		objs = []runtime.Object{
+			&operatorsv1alpha1.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Name: "ready", Namespace: "default"},
+				Status:     operatorsv1alpha1.HelmReleaseStatus{ProvisioningState: operatorsv1alpha1.ProvisioningStateSucceeded, Revision: 3},
+			},
+			&operatorsv1alpha1.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "default"},
+				Status:     operatorsv1alpha1.HelmReleaseStatus{ProvisioningState: operatorsv1alpha1.ProvisioningStateFailed, Revision: 1},
+			},
+			&operatorsv1alpha1.ClusterHelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Status:     operatorsv1alpha1.HelmReleaseStatus{ProvisioningState: operatorsv1alpha1.ProvisioningStateSucceeded, Revision: 2},
+			},
+			&operatorsv1alpha1.NginxIngress{
+				ObjectMeta: metav1.ObjectMeta{Name: "ingress", Namespace: "default"},
+				Status: operatorsv1alpha1.NginxIngressStatus{
+					PublicIPReady: true,
+					Conditions: []operatorsv1alpha1.Condition{
+						{Type: operatorsv1alpha1.ConditionPublicIPReady, Status: corev1.ConditionTrue},
+						{Type: operatorsv1alpha1.ConditionLoadBalancerReady, Status: corev1.ConditionFalse},
+						{Type: operatorsv1alpha1.ConditionReady, Status: corev1.ConditionUnknown},
+					},
+				},
+			},
+		}
+	})
+
+	newCollector := func(skipClusterReleases bool) *StateCollector {
+		s := runtime.NewScheme()
+		Expect(operatorsv1alpha1.AddToScheme(s)).To(Succeed())
+		return &StateCollector{
+			Reader:              fake.NewFakeClientWithScheme(s, objs...),
+			SkipClusterReleases: skipClusterReleases,
+		}
+	}
+
+	It("should report the state of each object", func() {
+		Expect(collect(newCollector(false))).To(Equal(map[string]float64{
+			"operators_helmrelease_revision name=ready namespace=default":                                 3,
+			"operators_helmrelease_ready name=ready namespace=default":                                    1,
+			"operators_helmrelease_revision name=broken namespace=default":                                1,
+			"operators_helmrelease_ready name=broken namespace=default":                                   0,
+			"operators_helmrelease_revision name=cluster namespace=":                                      2,
+			"operators_helmrelease_ready name=cluster namespace=":                                         1,
+			"operators_helmrelease_phase_count phase=Succeeded":                                           2,
+			"operators_helmrelease_phase_count phase=Failed":                                              1,
+			"operators_nginxingress_component_ready component=publicip name=ingress namespace=default":    1,
+			"operators_nginxingress_component_ready component=helmrelease name=ingress namespace=default": 0,
+			"operators_nginxingress_condition condition=PublicIPReady name=ingress namespace=default":     1,
+			"operators_nginxingress_condition condition=LoadBalancerReady name=ingress namespace=default": 0,
+			"operators_nginxingress_condition condition=Ready name=ingress namespace=default":             0,
+		}))
+	})
+
+	It("should leave out ClusterHelmReleases when asked to", func() {
+		values := collect(newCollector(true))
+		Expect(values).NotTo(HaveKey("operators_helmrelease_ready name=cluster namespace="))
+		Expect(values).To(HaveKeyWithValue("operators_helmrelease_phase_count phase=Succeeded", 1.0))
+		Expect(values).To(HaveKeyWithValue("operators_helmrelease_phase_count phase=Failed", 1.0))
+	})
+
+	It("should report only the objects it reconciles", func() {
+		c := newCollector(false)
+		c.Reconciles = func(obj metav1.Object) bool {
+			return obj.GetName() == "ready"
+		}
+		Expect(collect(c)).To(Equal(map[string]float64{
+			"operators_helmrelease_revision name=ready namespace=default": 3,
+			"operators_helmrelease_ready name=ready namespace=default":    1,
+			"operators_helmrelease_phase_count phase=Succeeded":           1,
+		}))
+	})
+})
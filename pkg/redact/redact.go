@@ -0,0 +1,181 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redact masks sensitive values before they reach logs, events,
+// status messages or errors.
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every sensitive value.
+const Mask = "*****"
+
+// Redactor replaces known sensitive values in text. The zero value and a nil
+// *Redactor are both usable and redact nothing.
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// New returns a Redactor masking secrets.
+func New(secrets ...string) *Redactor {
+	r := &Redactor{}
+	r.Add(secrets...)
+	return r
+}
+
+// Add registers more values to mask. Empty values are ignored.
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		r.secrets = append(r.secrets, secret)
+	}
+	// Replace longer values first so a secret containing another one is
+	// masked as a whole.
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+// String returns s with every registered value masked.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, Mask, -1)
+	}
+	return s
+}
+
+// Strings returns a copy of in with every element redacted.
+func (r *Redactor) Strings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+	out := make([]string, len(in))
+	for i := range in {
+		out[i] = r.String(in[i])
+	}
+	return out
+}
+
+// Error returns an error whose message is err's message redacted. The
+// original error is not retained, so nothing downstream can unwrap it back
+// into plaintext.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(r.String(err.Error()))
+}
+
+// Errorf is like fmt.Errorf, with the formatted message redacted.
+func (r *Redactor) Errorf(format string, args ...interface{}) error {
+	return errors.New(r.String(fmt.Sprintf(format, args...)))
+}
+
+// Writer redacts everything written through it before passing it on to the
+// underlying writer. Output is buffered by line so that a secret split across
+// two writes is still masked; call Flush to emit a trailing partial line.
+type Writer struct {
+	w        io.Writer
+	redactor *Redactor
+	buf      bytes.Buffer
+}
+
+// NewWriter returns a Writer redacting into w.
+func NewWriter(w io.Writer, redactor *Redactor) *Writer {
+	return &Writer{w: w, redactor: redactor}
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		if _, err := io.WriteString(w.w, w.redactor.String(string(line))); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line.
+func (w *Writer) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.w, w.redactor.String(w.buf.String()))
+	w.buf.Reset()
+	return err
+}
+
+// OverrideValue returns the value half of a helm --set override of the form
+// key=value, or the empty string if there is none.
+func OverrideValue(override string) string {
+	i := strings.Index(override, "=")
+	if i < 0 {
+		return ""
+	}
+	return override[i+1:]
+}
+
+// ValuesOf returns the scalar leaf values of a document decoded from YAML or
+// JSON, so that the values in a values file can be masked. Numbers and
+// booleans are returned as helm would print them; nulls are skipped.
+func ValuesOf(doc interface{}) []string {
+	var values []string
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			values = append(values, ValuesOf(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			values = append(values, ValuesOf(child)...)
+		}
+	case string:
+		values = append(values, v)
+	case float64:
+		values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+	case int64:
+		values = append(values, strconv.FormatInt(v, 10))
+	case int:
+		values = append(values, strconv.Itoa(v))
+	case bool:
+		values = append(values, strconv.FormatBool(v))
+	}
+	return values
+}
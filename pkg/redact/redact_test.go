@@ -0,0 +1,96 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("Redactor", func() {
+	const password = "hunter2-s3cr3t"
+
+	It("masks every occurrence of a secret", func() {
+		r := New(password)
+		out := r.String("--set db.password=" + password + " and again " + password)
+		Expect(out).NotTo(ContainSubstring(password))
+		Expect(out).To(Equal("--set db.password=" + Mask + " and again " + Mask))
+	})
+
+	It("masks the longer of two overlapping secrets as a whole", func() {
+		r := New("abc", "abcdef")
+		Expect(r.String("x=abcdef")).To(Equal("x=" + Mask))
+	})
+
+	It("ignores empty secrets and nil redactors", func() {
+		Expect(New("").String("unchanged")).To(Equal("unchanged"))
+		var r *Redactor
+		Expect(r.String("unchanged")).To(Equal("unchanged"))
+		Expect(r.Strings([]string{"a", "b"})).To(Equal([]string{"a", "b"}))
+	})
+
+	It("does not leak secrets through errors", func() {
+		r := New(password)
+		err := r.Error(errors.New("upgrade failed: value " + password + " rejected"))
+		Expect(err.Error()).NotTo(ContainSubstring(password))
+		Expect(r.Errorf("bad %s", password).Error()).To(Equal("bad " + Mask))
+		Expect(r.Error(nil)).To(BeNil())
+	})
+
+	It("masks secrets split across writes", func() {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, New(password))
+		_, err := w.Write([]byte("line one " + password[:5]))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write([]byte(password[5:] + "\nline two " + password))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Flush()).To(Succeed())
+		Expect(buf.String()).NotTo(ContainSubstring(password))
+		Expect(buf.String()).To(Equal("line one " + Mask + "\nline two " + Mask))
+	})
+
+	It("extracts the value of an override", func() {
+		Expect(OverrideValue("db.password=" + password)).To(Equal(password))
+		Expect(OverrideValue("a=b=c")).To(Equal("b=c"))
+		Expect(OverrideValue("foo")).To(Equal(""))
+	})
+
+	It("collects every scalar leaf of a values document", func() {
+		doc := map[string]interface{}{
+			"db": map[string]interface{}{
+				"password": password,
+				"port":     float64(5432),
+				"tls":      true,
+			},
+			"image": "nginx",
+			"users": []interface{}{"alice-token", nil, float64(12345678)},
+		}
+		Expect(ValuesOf(doc)).To(ConsistOf(password, "5432", "true", "nginx", "alice-token", "12345678"))
+	})
+
+	It("does not leak short or numeric values from a values file", func() {
+		var doc interface{}
+		Expect(yaml.Unmarshal([]byte("db:\n  password: ab12cd\n  pin: 4821\n"), &doc)).To(Succeed())
+		r := New(ValuesOf(doc)...)
+		out := r.String("Error: UPGRADE FAILED: password ab12cd and pin 4821 rejected")
+		Expect(out).NotTo(ContainSubstring("ab12cd"))
+		Expect(out).NotTo(ContainSubstring("4821"))
+	})
+})